@@ -1,3 +1,5 @@
 module github.com/lexndru/libcsv
 
 go 1.18
+
+require golang.org/x/text v0.14.0
@@ -20,240 +20,2167 @@
 package libcsv
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"os"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	OPT_MAX_READ     int64  = 1 << 20
+	OPT_DATE_LAYOUT  string = "2006-01-02"
+	OPT_SEPARATOR    string = "+"
+	OPT_DELIMITER    rune   = ','
+	OPT_SKIP_HEADER  bool   = false
+	OPT_GROUPING     string = ""    // thousands separator, guessed from the amount when empty
+	OPT_DECIMAL      string = ""    // decimal separator, "." or ",", guessed from the amount when empty
+	OPT_AMOUNT_SCALE int    = 2     // decimal places of the currency, e.g. 0 for JPY or 3 for BHD
+	OPT_DAY_FIRST    bool   = true  // dates in queries such as 10/01/2020 are dd/mm, otherwise mm/dd as in US
+	OPT_ANY_YEAR     bool   = false // month names without a year match every year, otherwise only the last one
+
+	OPT_TRANSFER_DAYS int   = 3 // internal transfers show up in both statements within these many days
+	OPT_TRANSFER_FEE  int64 = 0 // largest difference between the amounts of an internal transfer, e.g. a fee
+
+	OPT_DATE_FALLBACK_LAYOUTS []string = []string{} // tried in order when OPT_DATE_LAYOUT fails
 )
 
+type Locale struct {
+	Months   []string
+	Weekdays []string // starting with sunday, same as time.Weekday
+	Unicode  map[string]string
+
+	DecimalSep  string // same as OPT_DECIMAL when empty
+	GroupingSep string // same as OPT_GROUPING when empty
+}
+
+var localeMutex sync.RWMutex
+
+var locale = &Locale{
+	Months:  make([]string, 0),
+	Unicode: make(map[string]string),
+}
+
+var ErrAmbiguousMonth = errors.New("ambiguous month")
+
+// Month returns the index of the month starting at 0, or -1 if there's none
+// or monthName is the prefix of more than one, see LookupMonth
+func (lc *Locale) Month(monthName string) int {
+	i, _ := lc.LookupMonth(monthName)
+	return i
+}
+
+// LookupMonth finds the month written in full or as an unambiguous prefix,
+// e.g. "mar" or "mai" but not "ma" which fails with ErrAmbiguousMonth; english
+// names and abbreviations are used when the locale has no such month
+func (lc *Locale) LookupMonth(monthName string) (int, error) {
+	var matches []int
+
+	name := normalize(lc, monthName) // so both märz and maerz are fine
+	for i, m := range lc.Months {
+		if m = normalize(lc, m); m == name {
+			return i, nil
+		} else if name != "" && strings.HasPrefix(m, name) {
+			matches = append(matches, i)
+		}
+	}
+
+	if len(matches) == 1 {
+		return matches[0], nil
+	} else if len(matches) > 1 {
+		names := make([]string, 0, len(matches))
+		for _, i := range matches {
+			names = append(names, lc.Months[i])
+		}
+
+		return -1, fmt.Errorf("%w %q could be %s", ErrAmbiguousMonth, monthName, strings.Join(names, " or "))
+	}
+
+	// fallback on english, at least 3 letters as in statements (jan, feb, ...)
+	for m := time.January; len(name) > 2 && m <= time.December; m++ {
+		if strings.HasPrefix(strings.ToLower(m.String()), name) {
+			return int(m) - 1, nil
+		}
+	}
+
+	return -1, fmt.Errorf("unknown month %q", monthName)
+}
+
+// month is the same as LookupMonth but starts at 1, so unknown months are 0;
+// only ambiguous months fail
+func (lc *Locale) month(monthName string) (int, error) {
+	i, err := lc.LookupMonth(monthName)
+	if errors.Is(err, ErrAmbiguousMonth) {
+		return 0, err
+	}
+
+	return i + 1, nil
+}
+
+func (lc *Locale) Weekday(dayName string) int {
+	name := normalize(lc, dayName) // same as months
+	for i, d := range lc.Weekdays {
+		if strings.HasPrefix(normalize(lc, d), name) {
+			return i
+		}
+	}
+
+	for i := time.Sunday; i <= time.Saturday; i++ {
+		if strings.HasPrefix(strings.ToLower(i.String()), name) {
+			return int(i) // fallback on english
+		}
+	}
+
+	return -1
+}
+
+func (lc *Locale) separators() (decimal, grouping string) {
+	if decimal, grouping = lc.DecimalSep, lc.GroupingSep; decimal == "" {
+		decimal = OPT_DECIMAL
+	}
+
+	if grouping == "" {
+		grouping = OPT_GROUPING
+	}
+
+	return decimal, grouping
+}
+
+func (lc *Locale) Translate(text string) string {
+	for chr, val := range lc.Unicode {
+		text = strings.ReplaceAll(text, chr, val)
+	}
+
+	return text
+}
+
+// LoadLocale reads a locale pack written as json, e.g. {"months": ["ianuarie",
+// ...], "weekdays": [...], "unicode": {"ă": "a"}, "decimal": ",", "grouping": "."},
+// ready for Setup; months and weekdays are lowercased same as queries
+func LoadLocale(r io.Reader) (*Locale, error) {
+	var pack struct {
+		Months   []string          `json:"months"`
+		Weekdays []string          `json:"weekdays"`
+		Unicode  map[string]string `json:"unicode"`
+		Decimal  string            `json:"decimal"`
+		Grouping string            `json:"grouping"`
+	}
+
+	if err := json.NewDecoder(r).Decode(&pack); err != nil {
+		return nil, fmt.Errorf("not a locale: %w", err)
+	} else if len(pack.Months) != 0 && len(pack.Months) != 12 {
+		return nil, fmt.Errorf("expected 12 months, got %d", len(pack.Months))
+	} else if len(pack.Weekdays) != 0 && len(pack.Weekdays) != 7 {
+		return nil, fmt.Errorf("expected 7 weekdays, got %d", len(pack.Weekdays))
+	}
+
+	lc := &Locale{Months: make([]string, 0, len(pack.Months)), Unicode: pack.Unicode, DecimalSep: pack.Decimal, GroupingSep: pack.Grouping}
+	for _, m := range pack.Months {
+		lc.Months = append(lc.Months, strings.ToLower(m))
+	}
+
+	for _, d := range pack.Weekdays {
+		lc.Weekdays = append(lc.Weekdays, strings.ToLower(d))
+	}
+
+	if lc.Unicode == nil {
+		lc.Unicode = make(map[string]string)
+	}
+
+	return lc, nil
+}
+
+var _PRESETS = map[string]Locale{
+	"en": {
+		Months:   []string{"january", "february", "march", "april", "may", "june", "july", "august", "september", "october", "november", "december"},
+		Weekdays: []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"},
+		Unicode:  map[string]string{},
+	},
+	"ro": {
+		Months:   []string{"ianuarie", "februarie", "martie", "aprilie", "mai", "iunie", "iulie", "august", "septembrie", "octombrie", "noiembrie", "decembrie"},
+		Weekdays: []string{"duminică", "luni", "marți", "miercuri", "joi", "vineri", "sâmbătă"},
+		Unicode:  map[string]string{"ă": "a", "â": "a", "î": "i", "ș": "s", "ş": "s", "ț": "t", "ţ": "t"},
+	},
+	"de": {
+		Months:   []string{"januar", "februar", "märz", "april", "mai", "juni", "juli", "august", "september", "oktober", "november", "dezember"},
+		Weekdays: []string{"sonntag", "montag", "dienstag", "mittwoch", "donnerstag", "freitag", "samstag"},
+		Unicode:  map[string]string{"ä": "ae", "ö": "oe", "ü": "ue", "ß": "ss"},
+	},
+	"fr": {
+		Months:   []string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		Weekdays: []string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		Unicode:  map[string]string{"à": "a", "â": "a", "ç": "c", "é": "e", "è": "e", "ê": "e", "ë": "e", "î": "i", "ï": "i", "ô": "o", "û": "u", "ù": "u", "ü": "u", "œ": "oe", "æ": "ae"},
+	},
+}
+
+// PresetLocale returns a new locale with the months, weekdays and diacritics of
+// a language: en, ro, de or fr, regions such as en-US are ignored; separators
+// are left to be guessed since they differ by country more than by language
+func PresetLocale(lang string) (*Locale, error) {
+	lang = strings.ToLower(strings.SplitN(strings.ReplaceAll(lang, "_", "-"), "-", 2)[0])
+
+	preset, ok := _PRESETS[lang]
+	if !ok {
+		return nil, fmt.Errorf("unsupported locale %q", lang)
+	}
+
+	lc := &Locale{
+		Months:   append([]string{}, preset.Months...),
+		Weekdays: append([]string{}, preset.Weekdays...),
+		Unicode:  make(map[string]string, len(preset.Unicode)),
+	}
+
+	for chr, val := range preset.Unicode {
+		lc.Unicode[chr] = val
+	}
+
+	return lc, nil
+}
+
+func Setup(lc *Locale) {
+	localeMutex.Lock()
+	defer localeMutex.Unlock()
+
+	locale = lc
+}
+
+func CurrentLocale() *Locale {
+	localeMutex.RLock()
+	defer localeMutex.RUnlock()
+
+	return locale
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+func clean(s string) string {
+	return whitespace.ReplaceAllString(strings.TrimSpace(s), " ")
+}
+
+func parseDate(row []string, index int) (time.Time, error) {
+	text := clean(row[index])
+	val, err := time.Parse(OPT_DATE_LAYOUT, text)
+
+	for _, layout := range OPT_DATE_FALLBACK_LAYOUTS {
+		if err == nil {
+			break
+		} else if fallback, err := time.Parse(layout, text); err == nil {
+			return fallback, nil
+		}
+	}
+
+	if err != nil {
+		return val, fmt.Errorf("column %d: %v => %v", index, err, row)
+	}
+
+	return val, nil
+}
+
+func parseAmount(row []string, index int) (int64, error) {
+	val, err := toCents(clean(row[index]))
+
+	if err != nil {
+		return val, fmt.Errorf("column %d: %v => %v", index, err, row)
+	}
+
+	return val, nil
+}
+
 var (
-	OPT_MAX_READ    int64  = 1 << 20
-	OPT_DATE_LAYOUT string = "2006-01-02"
-	OPT_SEPARATOR   string = "+"
+	_AMOUNT_REGEX  = regexp.MustCompile(`^([-+]?) *(?:\p{Sc}|[A-Z]{3})? *([-+]?)(\d[\d.,' \x{a0}]*?) *(?:\p{Sc}|[A-Z]{3})? *$`) // currency symbol or code
+	_AMOUNT_SPACES = strings.NewReplacer(" ", "", "'", "", "\u00a0", "")
+
+	_OTHER_SEPARATOR = strings.NewReplacer(".", ",", ",", ".") // grouping when the other one is the decimal
 )
 
-type Locale struct {
-	Months  []string
-	Unicode map[string]string
+// toCents reads amounts such as -27.73, $1,000.50, 1 000,50 RON or -€1.000,50
+// with the separators of the current locale, if any;
+// amounts without decimals are considered to be in cents already (e.g. -4022),
+// or in the smallest unit of the currency given by OPT_AMOUNT_SCALE, unless
+// their digits are grouped: 1,000 and 1 000 are both 1000.00
+func toCents(text string) (int64, error) {
+	parts := _AMOUNT_REGEX.FindStringSubmatch(text)
+	if parts == nil || len(parts[1]+parts[2]) > 1 {
+		return 0, fmt.Errorf("not an amount %q", text)
+	}
+
+	decimalSep, grouping := CurrentLocale().separators()
+
+	sign, number := parts[1]+parts[2], _AMOUNT_SPACES.Replace(parts[3])
+	grouped := number != parts[3]
+	if grouping != "" {
+		grouped = grouped || strings.Contains(number, grouping)
+		number = strings.ReplaceAll(number, grouping, "")
+	}
+
+	dot, comma := strings.LastIndex(number, "."), strings.LastIndex(number, ",")
+	decimal := max(dot, comma)
+
+	if decimalSep != "" {
+		other := _OTHER_SEPARATOR.Replace(decimalSep)
+		grouped = grouped || strings.Contains(number, other)
+		number = strings.ReplaceAll(number, other, "")
+		if decimal = strings.LastIndex(number, decimalSep); strings.Count(number, decimalSep) > 1 {
+			return 0, fmt.Errorf("not an amount %q", text)
+		}
+	} else if grouping == "" && decimal > -1 {
+		if sep := number[decimal : decimal+1]; dot > -1 && comma > -1 {
+			number = strings.ReplaceAll(number, string(number[min(dot, comma)]), "")
+			decimal = strings.LastIndex(number, sep)
+		} else if number[0] != '0' && (strings.Count(number, sep) > 1 || len(number)-decimal-1 == 3 && OPT_AMOUNT_SCALE < 3) {
+			number = strings.ReplaceAll(number, sep, "") // e.g. 1,000 or 1.000.000 but not 0.125
+			decimal, grouped = -1, true
+		}
+	}
+
+	whole, fraction := number, ""
+	if decimal > -1 {
+		whole, fraction = number[:decimal], number[decimal+1:]
+	}
+
+	if len(fraction) > OPT_AMOUNT_SCALE {
+		return 0, fmt.Errorf("too many decimals %q", text)
+	} else if decimal > -1 {
+		whole += fraction + strings.Repeat("0", OPT_AMOUNT_SCALE-len(fraction))
+	} else if grouped {
+		whole += strings.Repeat("0", OPT_AMOUNT_SCALE) // grouped digits are whole units
+	}
+
+	return strconv.ParseInt(sign+whole, 10, 64)
+}
+
+type Record struct {
+	Sender   string
+	Receiver string
+	Label    string
+	Date     time.Time
+	Amount   int64 // sum
+	Line     int   // source line, shared by split records
+
+	ParentAmount int64  // sum of the combined row, only for split records
+	RawLabel     string // label of the combined row, only for split records
+	Part         int    // position in the combined row starting at 1, only for split records
+	Split        bool   // the label was split from a combined row, queried as [p=true]
+
+	Tags []string // left for users to set, e.g. reviewed or disputed, and queried as [g=disputed]
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf(`["%v","%v","%v",%v,%v]`, r.Sender, r.Receiver, r.Label, r.Date.Unix(), r.Amount)
+}
+
+// Equal compares all fields but the source line and the tags, so the same
+// transaction read from overlapping statements is equal
+func (r Record) Equal(o Record) bool {
+	return r.identity() == o.identity()
+}
+
+// identity holds the fields compared by Equal, also used by Dedup
+type identity struct {
+	sender, receiver, label string
+	date, amount            int64
+	parentAmount            int64
+	rawLabel                string
+	part                    int
+	split                   bool
+}
+
+func (r Record) identity() identity {
+	return identity{r.Sender, r.Receiver, r.Label, r.Date.UnixNano(), r.Amount, r.ParentAmount, r.RawLabel, r.Part, r.Split}
+}
+
+// OPT_RECORD_KEY tells records apart in unions, intersections, differences
+// and partitions; split records that look the same differ by their part
+var OPT_RECORD_KEY = func(r Record) string {
+	return fmt.Sprintf("%v@%d.%d", r, r.Line, r.Part)
+}
+
+func (r Record) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Sender   string `json:"sender"`
+		Receiver string `json:"receiver"`
+		Label    string `json:"label"`
+		Date     string `json:"date"`
+		Amount   int64  `json:"amount"`
+	}{r.Sender, r.Receiver, r.Label, r.Date.Format(time.RFC3339), r.Amount})
+}
+
+// Collection methods return new slices, so appending to or sorting results
+// never changes the collection they come from
+type Collection []Record
+
+// Clone returns a copy that doesn't share memory with c
+func (c Collection) Clone() Collection {
+	if c == nil {
+		return nil
+	}
+
+	clone := append(make(Collection, 0, len(c)), c...)
+	for i, r := range clone {
+		if r.Tags != nil {
+			clone[i].Tags = append([]string{}, r.Tags...)
+		}
+	}
+
+	return clone
+}
+
+type ColumnLayout struct {
+	Sender   int
+	Receiver int
+	Label    int
+	Date     int
+	Amount   int
+}
+
+var DefaultLayout = ColumnLayout{Sender: 0, Receiver: 1, Label: 2, Date: 3, Amount: 4}
+
+func (l ColumnLayout) columns() int {
+	var last int
+	for _, index := range []int{l.Sender, l.Receiver, l.Label, l.Date, l.Amount} {
+		if index < 0 {
+			return -1
+		} else if index > last {
+			last = index
+		}
+	}
+
+	return last + 1
+}
+
+// Options of a single parse, start from DefaultOptions() and change only what's
+// needed; global OPT_* values are used for everything else
+type Options struct {
+	Layout    ColumnLayout
+	Separator string // splits combined labels unless escaped as \+, empty to never split
+	MaxRead   int64  // 0 means unlimited
+	Delimiter rune   // same as OPT_DELIMITER when zero
+
+	// Clean is called with the sender, receiver and label as read, instead of
+	// trimming and collapsing whitespace, e.g. when spacing is significant
+	Clean func(text string) string
+
+	// Normalize is called with the header ('a', 'b' or 'c') and the cleaned
+	// sender, receiver or label, e.g. to map aliases to a canonical name
+	Normalize func(field byte, raw string) string
+
+	// Classify gives a label to records without one (empty or "?"), split
+	// records are classified one by one
+	Classify func(r Record) string
+
+	DebitCredit *DebitCredit // nil when amounts are signed
+}
+
+// DebitCredit is a column telling the sign of amounts, for banks writing
+// unsigned amounts next to a debit or credit indicator such as D or C
+type DebitCredit struct {
+	Column int
+	Debit  string // same as "D" when empty, case insensitive
+	Credit string // same as "C" when empty, case insensitive
+}
+
+func (dc *DebitCredit) sign(row []string) (int64, error) {
+	debit, credit := dc.Debit, dc.Credit
+	if debit == "" {
+		debit = "D"
+	}
+
+	if credit == "" {
+		credit = "C"
+	}
+
+	if value := clean(row[dc.Column]); strings.EqualFold(value, debit) {
+		return -1, nil
+	} else if strings.EqualFold(value, credit) {
+		return 1, nil
+	}
+
+	return 0, fmt.Errorf("column %d: not a debit or credit %q => %v", dc.Column, row[dc.Column], row)
+}
+
+// columns is the least number of columns of a row, or -1 if one is negative
+func (o Options) columns() int {
+	columns := o.Layout.columns()
+	if o.DebitCredit == nil || columns == -1 {
+		return columns
+	} else if o.DebitCredit.Column < 0 {
+		return -1
+	}
+
+	return max(columns, o.DebitCredit.Column+1)
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Layout:    DefaultLayout,
+		Separator: OPT_SEPARATOR,
+		MaxRead:   OPT_MAX_READ,
+		Delimiter: OPT_DELIMITER,
+	}
+}
+
+// New panics with a *ParseError if the source can't be read, see NewSafe
+func New(src io.Reader) Collection {
+	collection, err := NewSafe(src)
+
+	if parseErr := (*ParseError)(nil); err != nil && !errors.As(err, &parseErr) {
+		panic(&ParseError{Err: err, message: err.Error()}) // not about a row, e.g. ErrTooLarge
+	} else if err != nil {
+		panic(parseErr)
+	}
+
+	return collection
+}
+
+func NewSafe(src io.Reader) (Collection, error) {
+	return NewWithOptions(src, DefaultOptions())
+}
+
+func NewWithLayout(src io.Reader, layout ColumnLayout) (Collection, error) {
+	opts := DefaultOptions()
+	opts.Layout = layout
+
+	return NewWithOptions(src, opts)
+}
+
+// NewWithLimit reads at most limit bytes (0 means unlimited) and fails with
+// ErrTooLarge instead of truncating the source
+func NewWithLimit(src io.Reader, limit int64) (Collection, error) {
+	opts := DefaultOptions()
+	opts.MaxRead = limit
+
+	return NewWithOptions(src, opts)
+}
+
+var ErrTooLarge = errors.New("input exceeds read limit")
+
+var ErrMissingColumns = errors.New("missing columns")
+
+// ParseError tells which row of the source can't be read and why
+type ParseError struct {
+	Err  error
+	Row  []string // fields of the row, if it could be split at all
+	Line int      // row of the source, starting at 1
+
+	message string
+}
+
+func (e *ParseError) Error() string {
+	if e.message == "" && e.Err != nil { // built by the caller
+		return e.Err.Error()
+	}
+
+	return e.message
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+func parseErrorf(err error, row []string, line int, format string, args ...interface{}) error {
+	return &ParseError{err, row, line, fmt.Sprintf(format, args...)}
+}
+
+type maxReader struct {
+	src  io.Reader
+	left int64
+}
+
+func (m *maxReader) Read(p []byte) (int, error) {
+	if m.left <= 0 {
+		var probe [1]byte
+		if _, err := io.ReadFull(m.src, probe[:]); err == io.EOF {
+			return 0, io.EOF
+		}
+
+		return 0, ErrTooLarge
+	}
+
+	if int64(len(p)) > m.left {
+		p = p[:m.left]
+	}
+
+	n, err := m.src.Read(p)
+	m.left -= int64(n)
+
+	return n, err
+}
+
+func limited(src io.Reader, limit int64) io.Reader {
+	if limit > 0 {
+		return &maxReader{src, limit}
+	}
+
+	return src
+}
+
+func NewWithOptions(src io.Reader, opts Options) (Collection, error) {
+	if opts.columns() == -1 {
+		return nil, fmt.Errorf("negative column index in layout %+v", opts.Layout)
+	}
+
+	return newStream(limited(src, opts.MaxRead), opts).collect()
+}
+
+// RowReader reads the fields of a row at a time and returns io.EOF when done,
+// *csv.Reader is one; a FieldPos method gives the line of the row, otherwise
+// rows are counted as lines
+type RowReader interface {
+	Read() ([]string, error)
+}
+
+// NewFromRowReader builds records the same way as New from any kind of rows,
+// options only used by the csv reader (delimiter, max read) are ignored
+func NewFromRowReader(reader RowReader, opts Options) (Collection, error) {
+	if opts.columns() == -1 {
+		return nil, fmt.Errorf("negative column index in layout %+v", opts.Layout)
+	}
+
+	return newRowStream(reader, opts).collect()
+}
+
+func NewTSV(src io.Reader) (Collection, error) {
+	opts := DefaultOptions()
+	opts.Delimiter = '\t'
+
+	return NewWithOptions(src, opts)
+}
+
+// NewFixedWidth reads rows with columns of the given widths, in bytes, and
+// trims the spaces used as padding
+func NewFixedWidth(src io.Reader, widths []int) (Collection, error) {
+	for _, w := range widths {
+		if w <= 0 {
+			return nil, fmt.Errorf("incorrect column width %d in %v", w, widths)
+		}
+	}
+
+	reader := &fixedWidthReader{scanner: bufio.NewScanner(limited(src, OPT_MAX_READ)), widths: widths}
+
+	return NewFromRowReader(reader, DefaultOptions())
+}
+
+type fixedWidthReader struct {
+	scanner *bufio.Scanner
+	widths  []int
+	line    int
+}
+
+func (r *fixedWidthReader) Read() ([]string, error) {
+	for r.scanner.Scan() {
+		r.line++
+
+		text := strings.TrimRight(r.scanner.Text(), "\r")
+		if strings.TrimSpace(text) == "" {
+			continue // same as csv, empty lines are skipped
+		}
+
+		fields := make([]string, len(r.widths))
+		for i, w := range r.widths {
+			end := min(w, len(text))
+			fields[i], text = strings.TrimSpace(text[:end]), text[end:]
+		}
+
+		return fields, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, io.EOF
+}
+
+func (r *fixedWidthReader) FieldPos(field int) (line, column int) {
+	return r.line, 0
+}
+
+// NewFromFile reads the file at path and guesses its delimiter from the first
+// lines, it can be a comma, a semicolon or a tab
+func NewFromFile(path string) (Collection, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	src := bufio.NewReader(file)
+	head, err := src.Peek(_SNIFF_SIZE)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+
+	opts := DefaultOptions()
+	opts.Delimiter = sniffDelimiter(head)
+
+	return NewWithOptions(src, opts)
+}
+
+var _GZIP_MAGIC = []byte{0x1f, 0x8b}
+
+// NewAuto reads gzipped sources the same way as plain ones, e.g. archived
+// statements; the read limit applies to the decompressed csv
+func NewAuto(src io.Reader) (Collection, error) {
+	buffered := bufio.NewReader(src)
+	if magic, _ := buffered.Peek(len(_GZIP_MAGIC)); !bytes.Equal(magic, _GZIP_MAGIC) {
+		return NewSafe(buffered)
+	}
+
+	archive, err := gzip.NewReader(buffered)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	return NewSafe(archive)
+}
+
+const _SNIFF_SIZE = 4096 // first lines of the file
+
+var _DELIMITERS = []rune{',', ';', '\t'}
+
+// sniffDelimiter picks the delimiter found most times on every line, quoted
+// fields are ignored since they may contain commas (e.g. "1,5")
+func sniffDelimiter(head []byte) rune {
+	lines := strings.Split(strings.TrimSpace(string(head)), "\n")
+	if len(head) == _SNIFF_SIZE && len(lines) > 1 {
+		lines = lines[:len(lines)-1] // the last one can be incomplete
+	}
+
+	if len(lines) > 5 {
+		lines = lines[:5]
+	}
+
+	best, bestCount := OPT_DELIMITER, 0
+	for _, delimiter := range _DELIMITERS {
+		count := -1
+		for _, line := range lines {
+			var quoted bool
+			var n int
+			for _, chr := range line {
+				if chr == '"' {
+					quoted = !quoted
+				} else if chr == delimiter && !quoted {
+					n++
+				}
+			}
+
+			if count == -1 || n < count {
+				count = n
+			}
+		}
+
+		if count > bestCount {
+			best, bestCount = delimiter, count
+		}
+	}
+
+	return best
+}
+
+// NewStream yields one record at a time without loading the whole source in
+// memory (hence no OPT_MAX_READ), and returns io.EOF when done
+func NewStream(src io.Reader) func() (Record, error) {
+	return newStream(src, DefaultOptions()).next
+}
+
+// Validate parses the source the same way New does, but it doesn't stop on
+// the first incorrect row and returns the errors of all rows instead
+func Validate(src io.Reader) []error {
+	errs := make([]error, 0)
+	stream := newStream(limited(src, OPT_MAX_READ), DefaultOptions())
+
+	for {
+		if _, err := stream.next(); err == io.EOF {
+			break
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+
+		if stream.fatal != nil {
+			break
+		}
+	}
+
+	return errs
+}
+
+type stream struct {
+	reader  RowReader
+	opts    Options
+	columns int
+	rows    int
+	pending []Record // split records waiting to be flushed
+	fatal   error    // can't read past it, unlike errors of a single row
+}
+
+func newStream(src io.Reader, opts Options) *stream {
+	reader := csv.NewReader(src)
+	if reader.Comma = opts.Delimiter; reader.Comma == 0 {
+		reader.Comma = OPT_DELIMITER
+	}
+
+	return newRowStream(reader, opts)
+}
+
+func newRowStream(reader RowReader, opts Options) *stream {
+	return &stream{reader: reader, opts: opts, columns: opts.columns()}
+}
+
+func (s *stream) collect() (Collection, error) {
+	collection := make(Collection, 0)
+
+	for {
+		record, err := s.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		collection = append(collection, record)
+	}
+
+	return collection, nil
+}
+
+func (s *stream) next() (Record, error) {
+	for len(s.pending) == 0 {
+		row, err := s.reader.Read()
+		if err == io.EOF {
+			return Record{}, err
+		}
+
+		s.rows++
+		if parseErr := (*csv.ParseError)(nil); err != nil && !errors.As(err, &parseErr) {
+			s.fatal = err
+			return Record{}, err
+		} else if err != nil {
+			return Record{}, parseErrorf(err, row, s.rows, "row %d, %v", s.rows, err) // e.g. csv.ErrFieldCount
+		} else if s.rows == 1 && OPT_SKIP_HEADER {
+			continue // sender,receiver,label,date,amount
+		} else if len(row) < s.columns {
+			return Record{}, parseErrorf(ErrMissingColumns, row, s.rows, "row %d has %d columns, expected at least %d", s.rows, len(row), s.columns)
+		}
+
+		records, err := parseRow(row, s.opts)
+		if err != nil {
+			return Record{}, parseErrorf(err, row, s.rows, "row %d, %v", s.rows, err)
+		}
+
+		line := s.rows
+		if pos, ok := s.reader.(interface{ FieldPos(int) (int, int) }); ok {
+			line, _ = pos.FieldPos(0)
+		}
+
+		for i := range records {
+			records[i].Line = line
+			if s.opts.Classify != nil && isUnknown(records[i].Label) {
+				records[i].Label = s.opts.Classify(records[i])
+			}
+		}
+
+		s.pending = records
+	}
+
+	record := s.pending[0]
+	s.pending = s.pending[1:]
+
+	return record, nil
+}
+
+func parseRow(row []string, opts Options) ([]Record, error) {
+	layout := opts.Layout
+
+	cleanText := clean
+	if opts.Clean != nil {
+		cleanText = opts.Clean
+	}
+
+	text := func(field byte, raw string) string {
+		if opts.Normalize == nil {
+			return cleanText(raw)
+		}
+
+		return opts.Normalize(field, cleanText(raw))
+	}
+
+	date, err := parseDate(row, layout.Date)
+	if err != nil {
+		return nil, err
+	}
+
+	sum, err := parseAmount(row, layout.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.DebitCredit != nil {
+		sign, err := opts.DebitCredit.sign(row)
+		if err != nil {
+			return nil, err
+		}
+
+		sum = sign * abs(sum)
+	}
+
+	label, parts := row[layout.Label], []string{row[layout.Label]}
+	if opts.Separator != "" {
+		parts = splitLabel(label, opts.Separator)
+	}
+
+	if len(parts) == 1 {
+		return []Record{{
+			Sender:   text(HEADER_A_SENDER, row[layout.Sender]),
+			Receiver: text(HEADER_B_RECEIVER, row[layout.Receiver]),
+			Label:    text(HEADER_C_CATEGORY, parts[0]),
+			Date:     date,
+			Amount:   sum,
+		}}, nil
+	}
+
+	var k int64 = 1
+	if sum < 0 {
+		k = -1
+	}
+
+	var acc int64
+	var records = make([]Record, 0)
+	for i, each := range parts {
+		each = strings.TrimSpace(each)
+
+		pairs := []string{each, ""} // amount without label
+		if space := strings.IndexFunc(each, unicode.IsSpace); space > -1 {
+			pairs = []string{each[:space], strings.TrimLeftFunc(each[space:], unicode.IsSpace)}
+		}
+
+		subtotal, err := parseAmount(pairs, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		subtotal *= k
+		records = append(records, Record{
+			Sender:   text(HEADER_A_SENDER, row[layout.Sender]),
+			Receiver: text(HEADER_B_RECEIVER, row[layout.Receiver]),
+			Label:    text(HEADER_C_CATEGORY, pairs[1]), // new label
+			Date:     date,
+			Amount:   subtotal,
+
+			ParentAmount: sum,
+			RawLabel:     cleanText(label),
+			Part:         i + 1,
+			Split:        true,
+		})
+
+		acc += subtotal
+	}
+
+	if diff := sum - acc; diff != 0 {
+		return nil, fmt.Errorf("doesn't add up %v => %v", diff, row)
+	}
+
+	return records, nil
+}
+
+// splitLabel splits a combined label on sep, unless it's escaped with a backslash
+// as in "10 A\+ rating fee + 5 other fees"
+func splitLabel(label, sep string) []string {
+	var b strings.Builder
+	var parts []string
+
+	escaped := `\` + sep
+	for len(label) > 0 {
+		if strings.HasPrefix(label, escaped) {
+			b.WriteString(sep)
+			label = label[len(escaped):]
+		} else if strings.HasPrefix(label, sep) {
+			parts = append(parts, b.String())
+			b.Reset()
+			label = label[len(sep):]
+		} else {
+			b.WriteByte(label[0])
+			label = label[1:]
+		}
+	}
+
+	return append(parts, b.String())
+}
+
+const (
+	_UNION = '+'
+	_DIFF  = '-'
+	_INTER = '&'
+)
+
+func (c Collection) Filter(q string) (Collection, error) {
+	return c.FilterWithLocale(q, CurrentLocale())
+}
+
+func (c Collection) FilterWithLocale(q string, lc *Locale) (Collection, error) {
+	return c.filter(context.Background(), q, lc, nil)
+}
+
+// FilterContext stops early with the context's error once it's cancelled
+func (c Collection) FilterContext(ctx context.Context, q string) (Collection, error) {
+	return c.filter(ctx, q, CurrentLocale(), nil)
+}
+
+func (c Collection) filter(ctx context.Context, q string, lc *Locale, ix *IndexedCollection) (Collection, error) {
+	results, err := c.evaluate(ctx, q, lc, ix, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return before(results[i], results[j])
+	})
+
+	return results, nil
+}
+
+// FilterRaw works like Filter without sorting the results, e.g. to paginate them
+// right away; their order is unspecified, mostly the order in which they're scanned
+func (c Collection) FilterRaw(q string) (Collection, error) {
+	return c.evaluate(context.Background(), q, CurrentLocale(), nil, nil, nil)
+}
+
+// before tells if a comes first in filtered results: most recent, then smaller amounts
+func before(a, b Record) bool {
+	if a.Date.Equal(b.Date) {
+		return a.Amount < b.Amount
+	}
+
+	return a.Date.After(b.Date)
+}
+
+// Find returns the first record Filter would return, without sorting all results
+func (c Collection) Find(q string) (Record, bool, error) {
+	results, err := c.evaluate(context.Background(), q, CurrentLocale(), nil, nil, nil)
+	if err != nil || len(results) == 0 {
+		return Record{}, false, err
+	}
+
+	first := results[0]
+	for _, r := range results[1:] {
+		if before(r, first) {
+			first = r
+		}
+	}
+
+	return first, true, nil
+}
+
+// MatchedRecord is a result of FilterExplain along with the formula that
+// brought it, i.e. the first one of a union that kept it in the results
+type MatchedRecord struct {
+	Record  Record
+	Formula int    // position of the formula in the query, starting at 0, or -1 for an empty query
+	Source  string // formula as written, e.g. [a=catrina]
+}
+
+// FilterExplain works like Filter, but tells which formula brought each record
+func (c Collection) FilterExplain(q string) ([]MatchedRecord, error) {
+	var formulas []string
+	origin := make(map[string]int)
+
+	results, err := c.evaluate(context.Background(), q, CurrentLocale(), nil, func(_ int, t token, _ Collection) {
+		formulas = append(formulas, t.String())
+	}, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return before(results[i], results[j])
+	})
+
+	matches := make([]MatchedRecord, 0, len(results))
+	for _, r := range results {
+		if len(formulas) == 0 { // empty queries match everything without a formula
+			matches = append(matches, MatchedRecord{r, -1, ""})
+			continue
+		}
+
+		formula := origin[OPT_RECORD_KEY(r)]
+		matches = append(matches, MatchedRecord{r, formula, formulas[formula]})
+	}
+
+	return matches, nil
+}
+
+// ValidateQuery reports the errors of a query without running it on records,
+// e.g. unbalanced parenthesis, unknown headers or unsupported operators
+func ValidateQuery(q string) error {
+	var formulas []token
+	_, err := Collection{}.evaluate(context.Background(), q, CurrentLocale(), nil, func(_ int, t token, _ Collection) {
+		formulas = append(formulas, t)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	// some conditions fail only when compared, so compare them to a dummy record
+	for _, t := range formulas {
+		groups, err := prepareAny(&scope{t.flags&0b10 != 0, t.flags&0b01 != 0}, CurrentLocale(), t.value)
+		if err != nil {
+			return err
+		}
+
+		for _, filters := range groups {
+			for _, filter := range filters {
+				if _, err := filter.Compare(Record{}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// FilterFunc keeps the records satisfying pred in their original order, for
+// conditions the query can't express
+func (c Collection) FilterFunc(pred func(Record) bool) Collection {
+	results := make(Collection, 0)
+	for _, r := range c {
+		if pred(r) {
+			results = append(results, r)
+		}
+	}
+
+	return results
+}
+
+func (c Collection) Count(q string) (int, error) {
+	results, err := c.evaluate(context.Background(), q, CurrentLocale(), nil, nil, nil)
+
+	return len(results), err
+}
+
+// Dedup removes records equal to one seen before and keeps the order
+func (c Collection) Dedup() Collection {
+	seen := make(map[identity]bool, len(c))
+	records := make(Collection, 0, len(c))
+
+	for _, r := range c {
+		if key := r.identity(); !seen[key] {
+			seen[key] = true
+			records = append(records, r)
+		}
+	}
+
+	return records
+}
+
+// Merge concatenates collections, e.g. read from monthly files, and removes
+// the records equal to one seen before, just like Dedup
+func Merge(cols ...Collection) Collection {
+	var size int
+	for _, c := range cols {
+		size += len(c)
+	}
+
+	all := make(Collection, 0, size)
+	for _, c := range cols {
+		all = append(all, c...)
+	}
+
+	return all.Dedup()
+}
+
+// Partition splits the collection in records matching the query and the rest,
+// both in the original order
+func (c Collection) Partition(q string) (matched, rest Collection, err error) {
+	results, err := c.evaluate(context.Background(), q, CurrentLocale(), nil, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make(map[string]bool, len(results))
+	for _, r := range results {
+		keys[OPT_RECORD_KEY(r)] = true
+	}
+
+	matched, rest = make(Collection, 0, len(results)), make(Collection, 0, len(c)-len(results))
+	for _, r := range c {
+		if keys[OPT_RECORD_KEY(r)] {
+			matched = append(matched, r)
+		} else {
+			rest = append(rest, r)
+		}
+	}
+
+	return matched, rest, nil
+}
+
+// evaluate runs the query on every record, or only on the candidates found
+// in the index when there's one; trace, if any, gets the results of each formula
+// and origin, if any, gets the formula that brought each of the results
+func (c Collection) evaluate(ctx context.Context, q string, lc *Locale, ix *IndexedCollection, trace func(formula int, t token, out Collection), origin map[string]int) (Collection, error) {
+	var stack = make([]token, 0)
+	if err := compile(hideEscaped(clean(q)), &stack); err != nil {
+		return nil, err
+	} else if len(stack) == 0 {
+		return c.Clone(), nil // nothing to do?
+	}
+
+	var pos, formula int
+	var expression func(from map[string]int) (Collection, error)
+
+	// an operand is either a formula or a group of formulas between brackets;
+	// from is nil unless the origin of the records is needed
+	operand := func(from map[string]int) (Collection, error) {
+		switch t := stack[pos]; t.class {
+		case 1:
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			pos++
+			filters, err := prepareAny(&scope{t.flags&0b10 != 0, t.flags&0b01 != 0}, lc, t.value)
+			if err != nil {
+				return nil, err
+			}
+
+			base := c
+			if ix != nil {
+				base = ix.candidates(filters)
+			}
+
+			// empty formulas match everything, copy to avoid sorting c in place
+			out, err := queryAny(ctx, base, filters)
+			if err == nil && trace != nil {
+				trace(formula, t, out)
+			}
+
+			for i := 0; from != nil && i < len(out); i++ {
+				from[OPT_RECORD_KEY(out[i])] = formula
+			}
+
+			formula++
+			return append(Collection{}, out...), err
+		case 2:
+			pos++
+			out, err := expression(from)
+			if err != nil {
+				return nil, err
+			} else if pos >= len(stack) || stack[pos].class != 3 {
+				return nil, queryErrorf(ErrUnbalancedParens, q, "number of opened paranthesis don't match with closed ones")
+			}
+			pos++
+			return out, nil
+		}
+
+		return nil, queryErrorf(ErrIncorrectQuery, q, "incorrect query %v", q)
+	}
+
+	// operators have the same precedence and are applied from left to right
+	expression = func(from map[string]int) (Collection, error) {
+		results, err := operand(from)
+		for err == nil && pos < len(stack) && stack[pos].class != 3 {
+			op := stack[pos]
+			if op.class != 0 {
+				return nil, queryErrorf(ErrIncorrectQuery, string(op.value), "incorrect query, missing operation %v", op.value)
+			} else if pos++; pos >= len(stack) || (stack[pos].class != 1 && stack[pos].class != 2) {
+				return nil, queryErrorf(ErrIncorrectQuery, string(op.value), "incorrect query, missing formula %v", op.value)
+			}
+
+			var right map[string]int
+			if from != nil {
+				right = make(map[string]int)
+			}
+
+			var out Collection
+			if out, err = operand(right); err == nil {
+				results, err = combine(op, results, out)
+			}
+
+			if err == nil && from != nil {
+				attribute(from, right, results)
+			}
+		}
+
+		return results, err
+	}
+
+	results, err := expression(origin)
+	if err != nil {
+		return nil, err
+	} else if pos < len(stack) {
+		return nil, queryErrorf(ErrUnbalancedParens, q, "number of opened paranthesis don't match with closed ones")
+	}
+
+	return results, nil
+}
+
+// attribute keeps the origin of the combined records, the one of the left side
+// unless only the right side had the record, and forgets the records left out
+// so a record removed by - or & comes from the formula that brings it back
+func attribute(from, right map[string]int, results Collection) {
+	kept := make(map[string]bool, len(results))
+	for _, r := range results {
+		k := OPT_RECORD_KEY(r)
+		if _, ok := from[k]; !ok {
+			from[k] = right[k]
+		}
+		kept[k] = true
+	}
+
+	for k := range from {
+		if !kept[k] {
+			delete(from, k)
+		}
+	}
+}
+
+func combine(op token, left, right Collection) (Collection, error) {
+	keys := make(map[string]bool, len(right))
+	for _, r := range right {
+		keys[OPT_RECORD_KEY(r)] = true
+	}
+
+	results := make(Collection, 0, len(left))
+	switch op.value[0] {
+	case _UNION:
+		seen := make(map[string]bool, len(left))
+		for _, r := range left {
+			seen[OPT_RECORD_KEY(r)] = true
+			results = append(results, r)
+		}
+
+		for _, r := range right {
+			if k := OPT_RECORD_KEY(r); !seen[k] {
+				seen[k] = true
+				results = append(results, r)
+			}
+		}
+	case _DIFF, _INTER:
+		for _, r := range left {
+			if keys[OPT_RECORD_KEY(r)] == (op.value[0] == _INTER) {
+				results = append(results, r)
+			}
+		}
+	default:
+		return nil, queryErrorf(ErrUnsupportedOperator, string(op.value), "unsupported operator: %q", op.value)
+	}
+
+	return results, nil
+}
+
+func (c Collection) Page(offset, limit int) Collection {
+	if offset < 0 {
+		offset = 0
+	}
+
+	if offset >= len(c) || limit <= 0 {
+		return Collection{}
+	}
+
+	return c[offset:min(offset+limit, len(c))].Clone()
+}
+
+// Min, Max and Average use signed amounts, so Min is the largest expense and
+// all of them are zero for an empty collection
+func (c Collection) Min() (min int64) {
+	for i, r := range c {
+		if i == 0 || r.Amount < min {
+			min = r.Amount
+		}
+	}
+
+	return min
+}
+
+func (c Collection) Max() (max int64) {
+	for i, r := range c {
+		if i == 0 || r.Amount > max {
+			max = r.Amount
+		}
+	}
+
+	return max
+}
+
+func (c Collection) Average() float64 {
+	if len(c) == 0 {
+		return 0
+	}
+
+	return float64(c.Sum()) / float64(len(c))
+}
+
+// SortBy returns a stable sorted copy by date, amount, sender, receiver or
+// label; an unknown key keeps the current order
+func (c Collection) SortBy(key string, desc bool) Collection {
+	var less func(a, b Record) bool
+
+	switch key {
+	case "date":
+		less = func(a, b Record) bool { return a.Date.Before(b.Date) }
+	case "amount":
+		less = func(a, b Record) bool { return a.Amount < b.Amount }
+	case "sender":
+		less = func(a, b Record) bool { return a.Sender < b.Sender }
+	case "receiver":
+		less = func(a, b Record) bool { return a.Receiver < b.Receiver }
+	case "label":
+		less = func(a, b Record) bool { return a.Label < b.Label }
+	}
+
+	sorted := make(Collection, len(c))
+	copy(sorted, c)
+
+	if less != nil {
+		sort.SliceStable(sorted, func(i, j int) bool {
+			if desc {
+				return less(sorted[j], sorted[i])
+			}
+
+			return less(sorted[i], sorted[j])
+		})
+	}
+
+	return sorted
+}
+
+func (c Collection) Sum() (sum int64) {
+	for _, r := range c {
+		sum += r.Amount
+	}
+
+	return sum
+}
+
+// TopPercentile keeps the records in the top p percent by absolute amount, same
+// as the s header, so large expenses and large incomes alike; records with the
+// same amount as the threshold are all kept and the order is the same as c
+func (c Collection) TopPercentile(p float64) Collection {
+	amounts, k := c.percentileRank(p)
+	if k == 0 {
+		return Collection{}
+	}
+
+	threshold := amounts[len(amounts)-k]
+	return c.FilterFunc(func(r Record) bool { return abs(r.Amount) >= threshold })
+}
+
+// BottomPercentile keeps the records in the bottom p percent by absolute amount,
+// see TopPercentile
+func (c Collection) BottomPercentile(p float64) Collection {
+	amounts, k := c.percentileRank(p)
+	if k == 0 {
+		return Collection{}
+	}
+
+	threshold := amounts[k-1]
+	return c.FilterFunc(func(r Record) bool { return abs(r.Amount) <= threshold })
+}
+
+// percentileRank sorts the absolute amounts and tells how many of them are in p
+// percent, rounded up (nearest rank)
+func (c Collection) percentileRank(p float64) ([]int64, int) {
+	amounts := make([]int64, 0, len(c))
+	for _, r := range c {
+		amounts = append(amounts, abs(r.Amount))
+	}
+
+	sort.Slice(amounts, func(i, j int) bool { return amounts[i] < amounts[j] })
+
+	k := int(math.Ceil(float64(len(amounts)) * math.Min(math.Max(p, 0), 100) / 100))
+	return amounts, k
+}
+
+// Histogram counts records by absolute amount in buckets of bucketSize cents,
+// keyed by the lower bound, e.g. -75.00 is counted in 50.00-100.00 with a size
+// of 5000; zero amounts are in the first bucket and the map is empty if the
+// size is not positive
+func (c Collection) Histogram(bucketSize int64) map[int64]int {
+	buckets := make(map[int64]int)
+	if bucketSize <= 0 {
+		return buckets
+	}
+
+	for _, r := range c {
+		buckets[abs(r.Amount)/bucketSize*bucketSize]++
+	}
+
+	return buckets
+}
+
+// Reduce folds the records in their order, e.g. to count distinct merchants
+func Reduce[T any](c Collection, init T, fn func(acc T, r Record) T) T {
+	acc := init
+	for _, r := range c {
+		acc = fn(acc, r)
+	}
+
+	return acc
+}
+
+// DateRange returns the oldest and the most recent dates, both are zero times
+// if the collection is empty, see time.Time.IsZero
+func (c Collection) DateRange() (min, max time.Time) {
+	for i, r := range c {
+		if i == 0 || r.Date.Before(min) {
+			min = r.Date
+		}
+
+		if i == 0 || r.Date.After(max) {
+			max = r.Date
+		}
+	}
+
+	return min, max
+}
+
+// IsChronological tells if records go from the oldest to the most recent, as
+// read from most statements; Filter results are the other way around
+func (c Collection) IsChronological() bool {
+	for i := 1; i < len(c); i++ {
+		if c[i].Date.Before(c[i-1].Date) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type Stats struct {
+	Count     int
+	Total     int64 // signed, same as Sum
+	Income    int64
+	Expense   int64 // negative
+	First     time.Time
+	Last      time.Time
+	Merchants int // distinct receivers of expenses
+}
+
+// Stats summarizes the collection in a single pass, dates are zero times if
+// the collection is empty, same as DateRange
+func (c Collection) Stats() Stats {
+	var stats Stats
+	merchants := make(map[string]bool)
+
+	for i, r := range c {
+		if r.Amount > 0 {
+			stats.Income += r.Amount
+		} else if r.Amount < 0 {
+			stats.Expense += r.Amount
+			merchants[r.Receiver] = true
+		}
+
+		if i == 0 || r.Date.Before(stats.First) {
+			stats.First = r.Date
+		}
+
+		if i == 0 || r.Date.After(stats.Last) {
+			stats.Last = r.Date
+		}
+	}
+
+	stats.Count, stats.Total, stats.Merchants = len(c), stats.Income+stats.Expense, len(merchants)
+	return stats
+}
+
+// RunningBalance accumulates amounts from the oldest to the most recent record,
+// so balances follow the order of c.SortBy("date", false) not the order of c
+func (c Collection) RunningBalance() []int64 {
+	balances := make([]int64, len(c))
+
+	var balance int64
+	for i, r := range c.SortBy("date", false) {
+		balance += r.Amount
+		balances[i] = balance
+	}
+
+	return balances
+}
+
+// InternalTransfers pairs each expense between owners with the income it shows
+// up as in the other statement, e.g. from savings to checking, so it can be left
+// out of net worth; pairs follow each other in the results, expense first
+func (c Collection) InternalTransfers(owners []string) Collection {
+	isOwner := func(name string) bool {
+		for _, owner := range owners {
+			if strings.EqualFold(clean(owner), name) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	// the same parties, either way, with the sign and the amount that's expected
+	isPair := func(out, in Record) bool {
+		sameWay := strings.EqualFold(out.Sender, in.Sender) && strings.EqualFold(out.Receiver, in.Receiver)
+		otherWay := strings.EqualFold(out.Sender, in.Receiver) && strings.EqualFold(out.Receiver, in.Sender)
+
+		return in.Amount > 0 && (sameWay || otherWay) && abs(in.Amount+out.Amount) <= OPT_TRANSFER_FEE
+	}
+
+	days := func(a, b Record) int64 {
+		return abs(a.Date.Unix()-b.Date.Unix()) / (24 * 60 * 60)
+	}
+
+	used := make([]bool, len(c))
+	pairs := make(Collection, 0)
+	for i, out := range c {
+		if out.Amount >= 0 || !isOwner(out.Sender) || !isOwner(out.Receiver) {
+			continue
+		}
+
+		match := -1
+		for j, in := range c {
+			if used[j] || !isPair(out, in) || days(out, in) > int64(OPT_TRANSFER_DAYS) {
+				continue
+			} else if match == -1 || days(out, in) < days(out, c[match]) {
+				match = j // the closest one
+			}
+		}
+
+		if match > -1 {
+			used[i], used[match] = true, true
+			pairs = append(pairs, out, c[match])
+		}
+	}
+
+	return pairs
+}
+
+func (c Collection) GroupBy(header byte) (map[string]int64, error) {
+	var key func(r Record) string
+
+	switch header {
+	case HEADER_A_SENDER:
+		key = func(r Record) string { return r.Sender }
+	case HEADER_B_RECEIVER:
+		key = func(r Record) string { return r.Receiver }
+	case HEADER_C_CATEGORY:
+		key = func(r Record) string { return r.Label }
+	case HEADER_D_DATE:
+		key = func(r Record) string { return r.Date.Format(OPT_DATE_LAYOUT) }
+	default:
+		return nil, fmt.Errorf("unsupported group by header: %q", string(header))
+	}
+
+	groups := make(map[string]int64)
+	for _, r := range c {
+		groups[key(r)] += r.Amount
+	}
+
+	return groups, nil
+}
+
+type MonthBucket struct {
+	Year  int
+	Month time.Month
+	Total int64 // signed, so expenses and income cancel out
+	Count int
+}
+
+// ByMonth sums amounts by calendar month from the oldest to the most recent,
+// months without records are left out
+func (c Collection) ByMonth() []MonthBucket {
+	buckets := make([]MonthBucket, 0)
+	index := make(map[int]int)
+
+	for _, r := range c {
+		key := r.Date.Year()*100 + int(r.Date.Month())
+		if _, ok := index[key]; !ok {
+			index[key] = len(buckets)
+			buckets = append(buckets, MonthBucket{Year: r.Date.Year(), Month: r.Date.Month()})
+		}
+
+		buckets[index[key]].Total += r.Amount
+		buckets[index[key]].Count++
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].Year == buckets[j].Year {
+			return buckets[i].Month < buckets[j].Month
+		}
+
+		return buckets[i].Year < buckets[j].Year
+	})
+
+	return buckets
+}
+
+func (c Collection) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Comma = OPT_DELIMITER
+
+	for _, r := range c {
+		label := r.Label
+		if OPT_SEPARATOR != "" {
+			label = strings.ReplaceAll(label, OPT_SEPARATOR, `\`+OPT_SEPARATOR) // not split when read again
+		}
+
+		row := []string{r.Sender, r.Receiver, label, r.Date.Format(OPT_DATE_LAYOUT), formatAmount(r.Amount)}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// WriteJSON streams the records as a json array, one record per line
+func (c Collection) WriteJSON(w io.Writer) error {
+	if _, err := io.WriteString(w, "[\n"); err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	for i, r := range c {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+
+		if err := encoder.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(w, "]\n")
+	return err
+}
+
+// WriteNDJSON streams the records as newline delimited json
+func (c Collection) WriteNDJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	for _, r := range c {
+		if err := encoder.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func formatAmount(amount int64) string {
+	var sign string
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+
+	if OPT_AMOUNT_SCALE <= 0 {
+		return fmt.Sprintf("%s%d", sign, amount)
+	}
+
+	unit := int64(1)
+	for i := 0; i < OPT_AMOUNT_SCALE; i++ {
+		unit *= 10
+	}
+
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/unit, OPT_AMOUNT_SCALE, amount%unit)
+}
+
+// IndexedCollection keeps records sorted by date and amount, and grouped by
+// sender, receiver and label, so repeated queries don't scan every record
+type IndexedCollection struct {
+	records Collection
+	locale  *Locale
+
+	byDate   []int // positions of records, sorted by timestamp
+	byAmount []int // sorted by absolute amount
+	bySigned []int // sorted by signed amount
+
+	values map[byte]map[string][]int // normalized "=" or exact "'" text
+}
+
+// Index builds the index with the current locale, the collection must not be
+// changed afterwards
+func (c Collection) Index() *IndexedCollection {
+	ix := &IndexedCollection{records: c, locale: CurrentLocale(), values: make(map[byte]map[string][]int)}
+
+	sorted := func(key func(r Record) int64) []int {
+		positions := make([]int, len(c))
+		for i := range positions {
+			positions[i] = i
+		}
+
+		sort.SliceStable(positions, func(i, j int) bool {
+			return key(c[positions[i]]) < key(c[positions[j]])
+		})
+
+		return positions
+	}
+
+	ix.byDate = sorted(func(r Record) int64 { return day(r.Date) })
+	ix.byAmount = sorted(func(r Record) int64 { return abs(r.Amount) })
+	ix.bySigned = sorted(func(r Record) int64 { return r.Amount })
+
+	for _, header := range []byte{HEADER_A_SENDER, HEADER_B_RECEIVER, HEADER_C_CATEGORY} {
+		ix.values[header] = make(map[string][]int)
+	}
+
+	for i, r := range c {
+		for header, value := range map[byte]string{HEADER_A_SENDER: r.Sender, HEADER_B_RECEIVER: r.Receiver, HEADER_C_CATEGORY: r.Label} {
+			for _, key := range []string{"=" + normalize(ix.locale, value), "'" + value} {
+				ix.values[header][key] = append(ix.values[header][key], i)
+			}
+		}
+	}
+
+	return ix
 }
 
-var locale = &Locale{
-	Months:  make([]string, 0),
-	Unicode: make(map[string]string),
+// Filter returns the same results as Collection.Filter
+func (ix *IndexedCollection) Filter(q string) (Collection, error) {
+	return ix.records.filter(context.Background(), q, ix.locale, ix)
 }
 
-func (lc *Locale) Month(monthName string) int {
-	for i, m := range lc.Months {
-		if strings.HasPrefix(m, monthName) {
-			return i
+// candidates narrows the records down to a superset of the ones matching the
+// filters, in the original order
+func (ix *IndexedCollection) candidates(groups [][]comparator) Collection {
+	if len(groups) != 1 {
+		return ix.records // alternatives are not narrowed down
+	}
+
+	var found []int // sorted positions found so far
+	var narrowed bool
+	for _, c := range groups[0] {
+		positions, ok := ix.lookup(c)
+		if !ok {
+			continue
+		}
+
+		positions = append([]int{}, positions...)
+		sort.Ints(positions)
+
+		if !narrowed {
+			found, narrowed = positions, true
+			continue
+		}
+
+		both := found[:0]
+		for i, j := 0, 0; i < len(found) && j < len(positions); {
+			if found[i] < positions[j] {
+				i++
+			} else if found[i] > positions[j] {
+				j++
+			} else {
+				both = append(both, found[i])
+				i, j = i+1, j+1
+			}
 		}
+
+		found = both
 	}
 
-	return -1
-}
+	if !narrowed {
+		return ix.records
+	}
 
-func (lc *Locale) Translate(text string) string {
-	for chr, val := range lc.Unicode {
-		text = strings.ReplaceAll(text, chr, val)
+	records := make(Collection, 0, len(found))
+	for i, position := range found {
+		if i == 0 || position != found[i-1] { // x= can find the same record twice
+			records = append(records, ix.records[position])
+		}
 	}
 
-	return text
+	return records
 }
 
-func Setup(lc *Locale) {
-	locale = lc
+func (ix *IndexedCollection) lookup(c comparator) ([]int, bool) {
+	switch c.header {
+	case HEADER_D_DATE, HEADER_S_SUM, HEADER_V_SIGNED:
+		low, high, ok := c.bounds()
+		if !ok {
+			return nil, false
+		}
+
+		positions, key := ix.byDate, func(r Record) int64 { return day(r.Date) }
+		if c.header == HEADER_S_SUM {
+			positions, key = ix.byAmount, func(r Record) int64 { return abs(r.Amount) }
+		} else if c.header == HEADER_V_SIGNED {
+			positions, key = ix.bySigned, func(r Record) int64 { return r.Amount }
+		}
+
+		first := sort.Search(len(positions), func(i int) bool { return key(ix.records[positions[i]]) >= low })
+		last := sort.Search(len(positions), func(i int) bool { return key(ix.records[positions[i]]) > high })
+
+		return positions[first:max(first, last)], true
+	case HEADER_A_SENDER, HEADER_B_RECEIVER, HEADER_C_CATEGORY, HEADER_X_ANYONE, HEADER_Y_BOTH:
+		if c.operator != OPERATOR_EQUAL_MATCH || c.pattern != nil {
+			return nil, false
+		}
+
+		headers := []byte{c.header}
+		if c.header == HEADER_X_ANYONE {
+			headers = []byte{HEADER_A_SENDER, HEADER_B_RECEIVER}
+		} else if c.header == HEADER_Y_BOTH {
+			headers = []byte{HEADER_A_SENDER} // receivers are checked on the candidates
+		}
+
+		var positions []int
+		for _, k := range c.keywords {
+			var key string
+			if k.kind == _KW_EXACT && c.locale == ix.locale {
+				key = "=" + k.text
+			} else if k.kind == _KW_CASE {
+				key = "'" + k.text
+			} else {
+				return nil, false // prefixes are not indexed
+			}
+
+			for _, header := range headers {
+				positions = append(positions, ix.values[header][key]...)
+			}
+		}
+
+		return positions, true
+	}
+
+	return nil, false
 }
 
-var whitespace = regexp.MustCompile(`\s+`)
+var (
+	ErrIncorrectQuery      = errors.New("incorrect query")
+	ErrUnbalancedParens    = errors.New("unbalanced parenthesis")
+	ErrNestedParens        = errors.New("nested parenthesis")
+	ErrUnsupportedOperator = errors.New("unsupported operator")
+	ErrUnknownHeader       = errors.New("unknown header")
+	ErrInvalidValue        = errors.New("invalid value")
+)
 
-func clean(s string) string {
-	return whitespace.ReplaceAllString(strings.TrimSpace(s), " ")
+// QueryError is returned by Filter for incorrect queries, use errors.Is to
+// check its kind (one of the Err* above) and errors.As to get the token
+type QueryError struct {
+	Kind  error
+	Token string // offending part of the query
+
+	message string
+	cause   error // wrapped with %w, e.g. ErrAmbiguousMonth
 }
 
-func mustParseDate(row []string, index int) time.Time {
-	val, err := time.Parse(OPT_DATE_LAYOUT, clean(row[index]))
+func (e *QueryError) Error() string {
+	return e.message
+}
 
-	if err != nil {
-		throw(err, row)
-	}
+func (e *QueryError) Unwrap() error {
+	return e.Kind
+}
 
-	return val
+// Is matches the cause as well, so an ambiguous month is both ErrInvalidValue
+// and ErrAmbiguousMonth
+func (e *QueryError) Is(target error) bool {
+	return e.cause != nil && errors.Is(e.cause, target)
 }
 
-func mustParseAmount(row []string, index int) int64 {
-	str := strings.ReplaceAll(clean(row[index]), ".", "")
-	val, err := strconv.ParseInt(str, 10, 64)
+func queryErrorf(kind error, token string, format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	return &QueryError{kind, string(unescape([]byte(token))), string(unescape([]byte(err.Error()))), errors.Unwrap(err)}
+}
 
-	if err != nil {
-		throw(err, row)
+// Escape adds a backslash before the characters with a meaning in queries, so
+// text values such as "A, B (C)" can be matched literally: [b=A\, B \(C\)]
+//
+// The characters are brackets, parenthesis, ; | , and the backslash itself.
+// Quoted text values don't need escaping, [b="A, B (C)"] is an exact match and
+// [b='A, B (C)'] is a case sensitive one; the closing quote must be followed
+// by the end of the formula or by one of , ; |
+//
+// A leading / * ~ ' " ? or < is escaped as well, so the text isn't read as a
+// regex, a quoted value or another kind of keyword: [b=\/.*/] is a prefix
+func Escape(text string) string {
+	var b strings.Builder
+	if trimmed := strings.TrimLeft(text, " "); trimmed != "" && strings.IndexByte(_LITERAL, trimmed[0]) > -1 {
+		b.WriteString(text[:len(text)-len(trimmed)] + `\`)
+		text = trimmed
 	}
 
-	return val
+	for _, chr := range text {
+		if strings.ContainsRune(_ESCAPABLE, chr) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(chr)
+	}
+
+	return b.String()
 }
 
-func throw(e error, r []string) {
-	panic(fmt.Errorf("%v => %v", e, r))
+// QueryBuilder writes a formula with escaped text values, conditions are
+// joined by ";" and alternatives started with Or are joined by "|"
+type QueryBuilder struct {
+	alternatives [][]string
 }
 
-type Record struct {
-	Sender   string
-	Receiver string
-	Label    string
-	Date     time.Time
-	Amount   int64 // sum
+func Query() *QueryBuilder {
+	return &QueryBuilder{alternatives: [][]string{{}}}
 }
 
-func (r Record) String() string {
-	return fmt.Sprintf(`["%v","%v","%v",%v,%v]`, r.Sender, r.Receiver, r.Label, r.Date.Unix(), r.Amount)
+func (qb *QueryBuilder) where(header byte, operator string, value string) *QueryBuilder {
+	last := len(qb.alternatives) - 1
+	qb.alternatives[last] = append(qb.alternatives[last], string(header)+operator+value)
+
+	return qb
 }
 
-type Collection []Record
+func (qb *QueryBuilder) Sender(name string) *QueryBuilder {
+	return qb.where(HEADER_A_SENDER, "=", Escape(name))
+}
 
-func New(src io.Reader) Collection {
-	collection := make(Collection, 0)
-	reader := csv.NewReader(io.LimitReader(src, OPT_MAX_READ))
+func (qb *QueryBuilder) Receiver(name string) *QueryBuilder {
+	return qb.where(HEADER_B_RECEIVER, "=", Escape(name))
+}
 
-	for {
-		if row, err := reader.Read(); err == io.EOF {
-			break
-		} else if strings.Contains(row[2], OPT_SEPARATOR) {
-			sum := mustParseAmount(row, 4)
-			var k int64 = 1
-			if sum < 0 {
-				k = -1
-			}
+func (qb *QueryBuilder) Label(label string) *QueryBuilder {
+	return qb.where(HEADER_C_CATEGORY, "=", Escape(label))
+}
 
-			var acc int64
-			for _, each := range strings.Split(row[2], OPT_SEPARATOR) {
-				pairs := strings.SplitN(clean(each), " ", 2)
-				subtotal := mustParseAmount(pairs, 0) * k
-				collection = append(collection, Record{
-					Sender:   clean(row[0]),
-					Receiver: clean(row[1]),
-					Label:    clean(pairs[1]), // new label
-					Date:     mustParseDate(row, 3),
-					Amount:   subtotal,
-				})
+func (qb *QueryBuilder) Anyone(name string) *QueryBuilder {
+	return qb.where(HEADER_X_ANYONE, "=", Escape(name))
+}
 
-				acc += subtotal
-			}
+// amounts are in cents, same as Record.Amount, and written with the decimal
+// separator of OPT_DECIMAL or with a decimal comma
+func (qb *QueryBuilder) AmountEquals(amount int64) *QueryBuilder {
+	return qb.where(HEADER_S_SUM, "=", queryAmount(amount))
+}
 
-			if diff := sum - acc; diff != 0 {
-				throw(fmt.Errorf("doesn't add up %v", diff), row)
-			}
-		} else {
-			collection = append(collection, Record{
-				Sender:   clean(row[0]),
-				Receiver: clean(row[1]),
-				Label:    clean(row[2]),
-				Date:     mustParseDate(row, 3),
-				Amount:   mustParseAmount(row, 4),
-			})
-		}
+func (qb *QueryBuilder) AmountGreaterThan(amount int64) *QueryBuilder {
+	return qb.where(HEADER_S_SUM, ">", queryAmount(amount))
+}
+
+func (qb *QueryBuilder) AmountLessThan(amount int64) *QueryBuilder {
+	return qb.where(HEADER_S_SUM, "<", queryAmount(amount))
+}
+
+func queryAmount(amount int64) string {
+	if OPT_DECIMAL != "" {
+		return strings.Replace(formatAmount(amount), ".", OPT_DECIMAL, 1)
 	}
 
-	return collection
+	return strings.Replace(formatAmount(amount), ".", ",", 1)
 }
 
-const (
-	_UNION = '+'
-	_DIFF  = '-'
-)
+func (qb *QueryBuilder) DateEquals(date time.Time) *QueryBuilder {
+	return qb.where(HEADER_D_DATE, "=", date.Format("2006-01-02"))
+}
 
-func (c Collection) Filter(q string) (results Collection, err error) {
-	var stack = make([]token, 0)
-	err = compile(clean(q), &stack)
+func (qb *QueryBuilder) DateAfter(date time.Time) *QueryBuilder {
+	return qb.where(HEADER_D_DATE, ">", date.Format("2006-01-02"))
+}
 
-	if err != nil {
-		return nil, err
-	} else if len(stack) == 0 {
-		return c, nil // nothing to do?
-	}
+func (qb *QueryBuilder) DateBefore(date time.Time) *QueryBuilder {
+	return qb.where(HEADER_D_DATE, "<", date.Format("2006-01-02"))
+}
 
-	_mem := make(map[string]Record)
-	if start := stack[0]; start.IsFormula() {
-		cScope := scope{start.flags&0b10 != 0, start.flags&0b01 != 0}
-		if filters, err := prepare(&cScope, start.value); err != nil {
-			return nil, err
-		} else if out, err := query(c, filters); err != nil {
-			return nil, err
-		} else {
-			for _, r := range out {
-				k := r.String()
-				_mem[k] = r
-				results = append(results, r)
-			}
-		}
-	} else {
-		return results, fmt.Errorf("incorrect query %v", q)
-	}
+func (qb *QueryBuilder) Or() *QueryBuilder {
+	qb.alternatives = append(qb.alternatives, []string{})
 
-	for i := 1; i < len(stack); i += 2 {
-		op, ls := stack[i], stack[i+1]
+	return qb
+}
 
-		if op.IsFormula() {
-			return results, fmt.Errorf("incorrect query, missing operation %v", op.value)
-		} else if !ls.IsFormula() {
-			return results, fmt.Errorf("incorrect query, missing formula %v", op.value)
+// String returns an exclusive formula, e.g. (a=alex; s>1000 | b=catrina)
+func (qb *QueryBuilder) String() string {
+	alternatives := make([]string, 0, len(qb.alternatives))
+	for _, conditions := range qb.alternatives {
+		if len(conditions) > 0 {
+			alternatives = append(alternatives, strings.Join(conditions, "; "))
 		}
+	}
 
-		filters, err := prepare(&scope{ls.flags&0b10 != 0, ls.flags&0b01 != 0}, ls.value)
-		if err != nil {
-			return nil, err
-		}
+	return "(" + strings.Join(alternatives, " | ") + ")"
+}
 
-		switch op.value[0] {
-		case _UNION:
-			out, err := query(c, filters)
-			if err != nil {
-				return nil, err
-			}
+/******************************* internals ***********************************/
 
-			for _, r2 := range out {
-				var r2k = r2.String()
-				if _, ok := _mem[r2k]; !ok {
-					results = append(results, r2)
-					_mem[r2k] = r2
+const _ESCAPABLE = `[]();|,\`
+
+const _LITERAL = `/*~'"?<` // a leading \ makes the value a prefix, see Escape
+
+const _ESCAPED = '\uE000' // escaped characters are moved to the private use area while compiling
+
+// hideEscaped replaces escaped characters so they're not read as part of the
+// query, unescape brings them back once the values are split; regex values
+// are hidden like quoted ones but keep their backslashes, so /^(a|b)$/ is a
+// group and \( is still a literal parenthesis in /^\(.*\)$/
+func hideEscaped(q string) string {
+	var b strings.Builder
+	for i := 0; i < len(q); i++ {
+		if q[i] == '\\' && i+1 < len(q) && strings.IndexByte(_ESCAPABLE, q[i+1]) > -1 {
+			b.WriteRune(_ESCAPED + rune(q[i+1]))
+			i++
+		} else if end := closingQuote(q, i); end > -1 && q[i] == '/' {
+			for _, chr := range []byte(q[i : end+1]) {
+				if chr != '\\' && strings.IndexByte(_ESCAPABLE, chr) > -1 {
+					b.WriteRune(_ESCAPED + rune(chr))
+				} else {
+					b.WriteByte(chr)
 				}
 			}
-		case _DIFF:
-			out, err := query(results, filters)
-			if err != nil {
-				return nil, err
-			}
-
-			for _, r2 := range out {
-				delete(_mem, r2.String())
+			i = end
+		} else if end > -1 {
+			for _, chr := range []byte(q[i : end+1]) {
+				if strings.IndexByte(_ESCAPABLE, chr) > -1 {
+					b.WriteRune(_ESCAPED + rune(chr))
+				} else {
+					b.WriteByte(chr)
+				}
 			}
+			i = end
+		} else {
+			b.WriteByte(q[i])
+		}
+	}
 
-			out2 := make([]Record, 0, len(results)-len(out))
-			for _, val := range _mem {
-				out2 = append(out2, val)
-			}
+	return b.String()
+}
 
-			results = out2 // ?
-		default:
-			return results, fmt.Errorf("unsupported operator: %v", op.value[0])
-		}
+// closingQuote finds the end of a quoted value or of a regex starting at i,
+// if there's one
+func closingQuote(q string, i int) int {
+	if quote := q[i]; quote != '"' && quote != '\'' && quote != '/' {
+		return -1
+	} else if before := strings.TrimRight(q[:i], " "); before == "" || before[len(before)-1] != '=' && before[len(before)-1] != ',' {
+		return -1 // not the start of a value
 	}
 
-	sort.SliceStable(results, func(i, j int) bool {
-		if results[i].Date.Equal(results[j].Date) {
-			return results[i].Amount < results[j].Amount
+	for j := i + 1; j < len(q); j++ {
+		if q[j] != q[i] {
+			continue
 		}
 
-		return results[i].Date.After(results[j].Date)
-	})
+		if after := strings.TrimLeft(q[j+1:], " "); after == "" || strings.IndexByte(",;|])", after[0]) > -1 {
+			return j
+		}
+	}
 
-	return results, nil
+	return -1
 }
 
-/******************************* internals ***********************************/
+func unescape(value []byte) []byte {
+	return bytes.Map(func(r rune) rune {
+		if r >= _ESCAPED && r < _ESCAPED+utf8.RuneSelf {
+			return r - _ESCAPED
+		}
+		return r
+	}, value)
+}
 
 const (
 	_OP_SQ = '['
@@ -272,6 +2199,60 @@ func (t token) IsFormula() bool {
 	return t.class == 1
 }
 
+// String writes formulas back with their brackets, e.g. [a=catrina)
+func (t token) String() string {
+	if !t.IsFormula() {
+		return string(unescape(t.value))
+	}
+
+	open, close := "(", ")"
+	if t.flags&0b10 != 0 {
+		open = "["
+	}
+	if t.flags&0b01 != 0 {
+		close = "]"
+	}
+
+	return open + string(unescape(t.value)) + close
+}
+
+// groups are opened by class 2 tokens and closed by class 3 tokens
+func openGroups(stack []token) (n int) {
+	for _, t := range stack {
+		if t.class == 2 {
+			n++
+		} else if t.class == 3 {
+			n--
+		}
+	}
+
+	return n
+}
+
+// Token is a part of a compiled query, either a formula, an operator or the
+// parenthesis of a group of formulas, e.g. to highlight queries
+type Token struct {
+	Value     string // formulas are written without brackets, e.g. a=alex
+	IsFormula bool
+	Flags     int // 0b10 if the formula opens with [ and 0b01 if it closes with ]
+}
+
+// Compile splits a query into tokens without preparing the formulas, see
+// ValidateQuery to check them too
+func Compile(q string) ([]Token, error) {
+	var stack = make([]token, 0)
+	if err := compile(hideEscaped(clean(q)), &stack); err != nil {
+		return nil, err
+	}
+
+	tokens := make([]Token, 0, len(stack))
+	for _, t := range stack {
+		tokens = append(tokens, Token{string(unescape(t.value)), t.IsFormula(), t.flags})
+	}
+
+	return tokens, nil
+}
+
 func compile(str string, stack *[]token) error {
 	if len(str) == 0 {
 		return nil
@@ -281,10 +2262,18 @@ func compile(str string, stack *[]token) error {
 		opCount := strings.Count(str, string(_OP_RD)) + strings.Count(str, string(_OP_SQ))
 		clCount := strings.Count(str, string(_CL_RD)) + strings.Count(str, string(_CL_SQ))
 		if opCount != clCount {
-			return fmt.Errorf("number of opened paranthesis don't match with closed ones")
+			return queryErrorf(ErrUnbalancedParens, str, "number of opened paranthesis don't match with closed ones")
 		}
 	}
 
+	if chr := str[0]; (chr == _OP_SQ || chr == _OP_RD) && strings.IndexAny(clean(str[1:]), "([") == 0 {
+		*stack = append(*stack, token{[]byte{chr}, 0, 2})
+		return compile(clean(str[1:]), stack)
+	} else if rest := clean(str); len(rest) > 0 && (rest[0] == _CL_SQ || rest[0] == _CL_RD) && openGroups(*stack) > 0 {
+		*stack = append(*stack, token{[]byte{rest[0]}, 0, 3})
+		return compile(clean(rest[1:]), stack)
+	}
+
 	if chr := str[0]; chr == _OP_SQ || chr == _OP_RD {
 		clsq := strings.IndexRune(str, _CL_SQ)
 		clrd := strings.IndexRune(str, _CL_RD)
@@ -299,7 +2288,7 @@ func compile(str string, stack *[]token) error {
 		}
 
 		if cl == -1 {
-			return fmt.Errorf("formula %v does't have a closing parenthesis", str)
+			return queryErrorf(ErrUnbalancedParens, str, "formula %v does't have a closing parenthesis", str)
 		}
 
 		var flags int
@@ -338,15 +2327,15 @@ func compile(str string, stack *[]token) error {
 
 		if op == -1 {
 			if strings.IndexRune(str, _CL_SQ)+strings.IndexRune(str, _CL_RD) > -2 && len(*stack) > 0 {
-				return fmt.Errorf("unsupported nested paranthesis in %s", (*stack)[len(*stack)-1].value)
+				return queryErrorf(ErrNestedParens, string((*stack)[len(*stack)-1].value), "unsupported nested paranthesis in %s", (*stack)[len(*stack)-1].value)
 			}
 
-			return fmt.Errorf("expected opening parenthesis after operator in %v", str)
+			return queryErrorf(ErrIncorrectQuery, str, "expected opening parenthesis after operator in %v", str)
 		}
 
 		operator := clean(str[:op])
 		if len(operator) != 1 {
-			return fmt.Errorf("unexpected operation between collections: %v", operator)
+			return queryErrorf(ErrUnsupportedOperator, operator, "unexpected operation between collections: %v", operator)
 		}
 
 		otoken := token{[]byte(operator), 0, 0}
@@ -368,6 +2357,22 @@ func min(a, b int) int {
 	return b
 }
 
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+
+	return n
+}
+
 const (
 	HEADER_A_SENDER   byte = 'a'
 	HEADER_B_RECEIVER byte = 'b'
@@ -375,13 +2380,23 @@ const (
 	HEADER_D_DATE     byte = 'd'
 	HEADER_S_SUM      byte = 's'
 	HEADER_X_ANYONE   byte = 'x' // hidden header, "either sender or receiver" is ORing trx party
+	HEADER_Y_BOTH     byte = 'y' // hidden header, "both sender and receiver" is ANDing trx party
+	HEADER_N_NEITHER  byte = 'n' // hidden header, "neither sender nor receiver", same as "x!="
 	HEADER_0_BALANCE  byte = 'z' // hidden header, "by reference to zero" is positive or negative
+	HEADER_W_WEEKDAY  byte = 'w' // hidden header, day of week of the date
+	HEADER_V_SIGNED   byte = 'v' // hidden header, signed sum so "v<-1000" is the same as "s>1000; z<0"
+	HEADER_T_TYPE     byte = 't' // hidden header, "t=income" is the same as "z>0" and "t=expense" as "z<0"
+	HEADER_G_TAG      byte = 'g' // hidden header, one of the tags set by users, e.g. "g=reviewed, disputed"
+	HEADER_U_UNKNOWN  byte = 'u' // hidden header, "u=?" is ORing unknown sender, receiver or label
+	HEADER_R_RAW      byte = 'r' // hidden header, label as read from the source, combined for split records
+	HEADER_P_SPLIT    byte = 'p' // hidden header, "p=true" for records split from a combined row, "p=false" otherwise
 )
 
 const (
 	OPERATOR_EQUAL_MATCH  byte = '='
 	OPERATOR_GREATER_THAN byte = '>'
 	OPERATOR_LESS_THAN    byte = '<'
+	OPERATOR_NOT_MATCH    byte = '!' // written as !=
 )
 
 type scope struct {
@@ -389,24 +2404,105 @@ type scope struct {
 	isRightInclusive bool
 }
 
-var nonAlphaNumeric = regexp.MustCompile(`[^a-z0-9]`)
+// unknown values are written as "?" or left empty in the csv, both keywords
+// match either of them and nothing else
+const (
+	_UNKNOWN_VALUE = "?"
+	_EMPTY_VALUE   = "<empty>"
+)
+
+func isUnknown(value string) bool {
+	value = clean(value)
+	return value == "" || value == _UNKNOWN_VALUE
+}
+
+// alphaNumeric replaces everything but a-z and 0-9 with spaces
+func alphaNumeric(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return ' '
+	}, text)
+}
+
+// stripMarks removes diacritics left after the locale translation, e.g. "Că"
+// becomes "Ca", so accents don't need to be listed in Locale.Unicode
+func stripMarks(text string) string {
+	for i := 0; i < len(text); i++ {
+		if text[i] >= utf8.RuneSelf {
+			return norm.NFC.String(strings.Map(func(r rune) rune {
+				if unicode.Is(unicode.Mn, r) {
+					return -1
+				}
+				return r
+			}, norm.NFD.String(text)))
+		}
+	}
+
+	return text // ascii only
+}
+
+// normalize lowers, translates and strips diacritics the same way for both
+// keywords and values
+func normalize(lc *Locale, text string) string {
+	return stripMarks(lc.Translate(strings.ToLower(text)))
+}
+
+const (
+	_KW_PREFIX   = iota // alex
+	_KW_CONTAINS        // *alex*
+	_KW_EXACT           // "alex"
+	_KW_CASE            // 'Alex'
+	_KW_UNKNOWN         // ? or <empty>
+	_KW_WORD            // ~alex, prefix of any word, e.g. online alexandria
+)
+
+// keyword is normalized once when the query is prepared, so only the values
+// of the records are normalized while filtering
+type keyword struct {
+	kind int
+	text string
+}
 
-func doesItMatch(keyword string, value string) bool {
-	lastIndex := len(keyword) - 1
-	asciiKeyword := locale.Translate(strings.ToLower(keyword))
-	asciiLookupValue := locale.Translate(strings.ToLower(value))
+func newKeyword(lc *Locale, text string) keyword {
+	if text == _UNKNOWN_VALUE || strings.EqualFold(text, _EMPTY_VALUE) {
+		return keyword{_KW_UNKNOWN, text}
+	}
 
-	if asciiKeyword[0] == '"' && asciiKeyword[lastIndex] == '"' {
-		return asciiLookupValue == asciiKeyword[1:lastIndex]
+	if last := len(text) - 1; last > 0 && text[0] == '\'' && text[last] == '\'' {
+		return keyword{_KW_CASE, text[1:last]}
 	}
 
-	if strings.HasPrefix(asciiLookupValue, asciiKeyword) {
-		return true
+	ascii := normalize(lc, text)
+	if last := len(ascii) - 1; last > 0 && ascii[0] == '"' && ascii[last] == '"' {
+		return keyword{_KW_EXACT, ascii[1:last]}
+	} else if last > 1 && ascii[0] == '*' && ascii[last] == '*' {
+		return keyword{_KW_CONTAINS, ascii[1:last]}
+	} else if last > 0 && ascii[0] == '~' {
+		return keyword{_KW_WORD, strings.Join(strings.Fields(alphaNumeric(ascii[1:])), " ")}
 	}
 
-	az09 := strings.TrimSpace(nonAlphaNumeric.ReplaceAllString(asciiLookupValue, " "))
+	return keyword{_KW_PREFIX, ascii}
+}
+
+// matches expects the value as written, normalized and with symbols replaced
+// by spaces
+func (k keyword) matches(value, ascii, az09 string) bool {
+	switch k.kind {
+	case _KW_UNKNOWN:
+		return isUnknown(value)
+	case _KW_CASE:
+		return value == k.text
+	case _KW_EXACT:
+		return ascii == k.text
+	case _KW_CONTAINS:
+		return strings.Contains(ascii, k.text) || strings.Contains(az09, k.text)
+	case _KW_WORD:
+		return strings.Contains(" "+strings.Join(strings.Fields(az09), " "), " "+k.text)
+	}
 
-	return strings.HasPrefix(az09, asciiKeyword)
+	return strings.HasPrefix(ascii, k.text) || strings.HasPrefix(strings.TrimSpace(az09), k.text)
 }
 
 var _TEXT_OR_SEP = []byte(",")
@@ -419,57 +2515,182 @@ type comparator struct {
 	numberValue int64  // timestamp, amount
 	offsetValue int64  // range for timestamp, amount to calc. aprox. values
 
-	intervalScope *scope
+	pattern  *regexp.Regexp // sender, receiver, label written as /regex/
+	keywords []keyword      // sender, receiver, label separated by commas
+	locale   *Locale
+	isRange  bool         // timestamp, amount written as low..high
+	values   []comparator // timestamps, amounts separated by commas
+	month    time.Month   // month name without a year, only with OPT_ANY_YEAR
+
+	intervalScope *scope
+}
+
+func (c comparator) isMatchingText(value string) bool {
+	if c.pattern != nil {
+		return c.pattern.MatchString(value) || c.pattern.MatchString(c.locale.Translate(value))
+	}
+
+	var ascii, az09 string
+	var normalized bool
+	for _, k := range c.keywords {
+		if !normalized && k.kind != _KW_UNKNOWN && k.kind != _KW_CASE {
+			ascii, normalized = normalize(c.locale, value), true
+			az09 = alphaNumeric(ascii)
+		}
+
+		if k.matches(value, ascii, az09) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c comparator) IsMatchingSender(r Record) bool {
+	return c.isMatchingText(r.Sender)
+}
+
+func (c comparator) IsMatchingReceiver(r Record) bool {
+	return c.isMatchingText(r.Receiver)
+}
+
+func (c comparator) IsMatchingSenderOrReceiver(r Record) bool {
+	return c.isMatchingText(r.Sender) || c.isMatchingText(r.Receiver)
+}
+
+// IsMatchingSenderAndReceiver checks each party against all the values, so
+// "y=alex, catrina" matches transfers between any two of them, even alex to alex
+func (c comparator) IsMatchingSenderAndReceiver(r Record) bool {
+	return c.isMatchingText(r.Sender) && c.isMatchingText(r.Receiver)
+}
+
+func (c comparator) IsMatchingLabel(r Record) bool {
+	return c.isMatchingText(r.Label)
+}
+
+func (c comparator) IsUncategorized(r Record) bool {
+	return isUnknown(r.Sender) || isUnknown(r.Receiver) || isUnknown(r.Label)
+}
+
+// IsMatchingRawLabel checks the combined label of split records, and the label
+// of the others
+func (c comparator) IsMatchingRawLabel(r Record) bool {
+	if r.RawLabel == "" {
+		return c.isMatchingText(r.Label)
+	}
+
+	return c.isMatchingText(r.RawLabel)
+}
+
+// IsTagged checks the tags as they are, but case insensitive
+func (c comparator) IsTagged(r Record) bool {
+	for _, v := range bytes.Split(c.bytesValue, _TEXT_OR_SEP) {
+		for _, tag := range r.Tags {
+			if strings.EqualFold(tag, string(bytes.TrimSpace(v))) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// inRange checks a value against low..high, bounds follow the formula's brackets
+func (c comparator) inRange(value int64) bool {
+	if c.intervalScope.isLeftInclusive && value < c.numberValue || !c.intervalScope.isLeftInclusive && value <= c.numberValue {
+		return false
+	}
+
+	if c.intervalScope.isRightInclusive {
+		return value <= c.numberValue+c.offsetValue
+	}
+
+	return value < c.numberValue+c.offsetValue
 }
 
-func (c comparator) isMatchingText(value string) bool {
-	for _, v := range bytes.Split(c.bytesValue, _TEXT_OR_SEP) {
-		if doesItMatch(string(v), value) {
-			return true
-		}
+// bounds returns the closed interval of timestamps or amounts matching the
+// condition, if there's one
+func (c comparator) bounds() (low, high int64, ok bool) {
+	if len(c.values) > 0 || c.month > 0 && c.operator != OPERATOR_GREATER_THAN && c.operator != OPERATOR_LESS_THAN {
+		return 0, 0, false // not a single interval
 	}
 
-	return false
-}
+	low, high = math.MinInt64, math.MaxInt64
 
-func (c comparator) IsMatchingSender(r Record) bool {
-	return c.isMatchingText(r.Sender)
-}
+	left, right := c.numberValue, c.numberValue
+	if c.header == HEADER_D_DATE {
+		left, right = c.numberValue+c.offsetValue, c.numberValue+c.offsetValue
+	}
 
-func (c comparator) IsMatchingReceiver(r Record) bool {
-	return c.isMatchingText(r.Receiver)
-}
+	switch c.operator {
+	case OPERATOR_GREATER_THAN:
+		if c.intervalScope.isLeftInclusive {
+			low = c.numberValue
+		} else {
+			low = left + 1
+		}
+	case OPERATOR_LESS_THAN:
+		if c.intervalScope.isRightInclusive {
+			high = right
+		} else {
+			high = c.numberValue - 1
+		}
+	case OPERATOR_EQUAL_MATCH:
+		if c.isRange {
+			low, high = c.numberValue+1, c.numberValue+c.offsetValue-1
+			if c.intervalScope.isLeftInclusive {
+				low = c.numberValue
+			}
 
-func (c comparator) IsMatchingSenderOrReceiver(r Record) bool {
-	return c.isMatchingText(r.Sender) || c.isMatchingText(r.Receiver)
+			if c.intervalScope.isRightInclusive {
+				high = c.numberValue + c.offsetValue
+			}
+		} else if c.header == HEADER_V_SIGNED && c.numberValue < 0 {
+			low, high = c.numberValue-c.offsetValue, c.numberValue
+		} else if c.offsetValue > 0 || c.header == HEADER_V_SIGNED {
+			low, high = c.numberValue, c.numberValue+c.offsetValue
+		} else {
+			low, high = c.numberValue, c.numberValue
+		}
+	default:
+		return 0, 0, false
+	}
+
+	return low, high, true
 }
 
-func (c comparator) IsMatchingLabel(r Record) bool {
-	return c.isMatchingText(r.Label)
+// day is the local wall-clock date of t, in its own location, moved to midnight
+// in UTC as dates in queries are, so times of the day are ignored
+func day(t time.Time) int64 {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix()
 }
 
 func (c comparator) IsMatchingDate(r Record) bool {
-	if c.offsetValue > 0 {
-		return r.Date.Unix() >= c.numberValue && r.Date.Unix() <= c.numberValue+c.offsetValue
+	if c.month > 0 {
+		return r.Date.Month() == c.month
+	} else if c.isRange {
+		return c.inRange(day(r.Date))
+	} else if c.offsetValue > 0 {
+		return day(r.Date) >= c.numberValue && day(r.Date) <= c.numberValue+c.offsetValue
 	}
 
-	return r.Date.Unix() == c.numberValue
+	return day(r.Date) == c.numberValue
 }
 
 func (c comparator) IsAfterDate(r Record) bool {
 	if c.intervalScope.isLeftInclusive {
-		return r.Date.Unix() >= c.numberValue
+		return day(r.Date) >= c.numberValue
 	}
 
-	return r.Date.Unix() > c.numberValue+c.offsetValue
+	return day(r.Date) > c.numberValue+c.offsetValue
 }
 
 func (c comparator) IsBeforeDate(r Record) bool {
 	if c.intervalScope.isRightInclusive {
-		return r.Date.Unix() <= c.numberValue+c.offsetValue
+		return day(r.Date) <= c.numberValue+c.offsetValue
 	}
 
-	return r.Date.Unix() < c.numberValue
+	return day(r.Date) < c.numberValue
 }
 
 func (c comparator) IsMatchingAmount(r Record) bool {
@@ -480,7 +2701,9 @@ func (c comparator) IsMatchingAmount(r Record) bool {
 		amount = r.Amount
 	}
 
-	if c.offsetValue > 0 {
+	if c.isRange {
+		return c.inRange(amount)
+	} else if c.offsetValue > 0 {
 		return amount >= c.numberValue && amount <= c.numberValue+c.offsetValue
 	}
 
@@ -517,6 +2740,32 @@ func (c comparator) IsLessThanAmount(r Record) bool {
 	return amount < c.numberValue
 }
 
+func (c comparator) IsMatchingSignedAmount(r Record) bool {
+	if c.isRange {
+		return c.inRange(r.Amount)
+	} else if c.numberValue < 0 {
+		return r.Amount >= c.numberValue-c.offsetValue && r.Amount <= c.numberValue
+	}
+
+	return r.Amount >= c.numberValue && r.Amount <= c.numberValue+c.offsetValue
+}
+
+func (c comparator) IsGreaterThanSignedAmount(r Record) bool {
+	if c.intervalScope.isLeftInclusive {
+		return r.Amount >= c.numberValue
+	}
+
+	return r.Amount > c.numberValue
+}
+
+func (c comparator) IsLessThanSignedAmount(r Record) bool {
+	if c.intervalScope.isRightInclusive {
+		return r.Amount <= c.numberValue
+	}
+
+	return r.Amount < c.numberValue
+}
+
 func (c comparator) HasAscendingAmount(r Record) bool {
 	return r.Amount > c.numberValue
 }
@@ -525,57 +2774,163 @@ func (c comparator) HasDescendingAmount(r Record) bool {
 	return r.Amount < c.numberValue
 }
 
+func (c comparator) IsMatchingWeekday(r Record) bool {
+	return int64(r.Date.Weekday()) == c.numberValue
+}
+
+func (c comparator) unsupportedOperator() error {
+	return queryErrorf(ErrUnsupportedOperator, string(c.operator), "unsupported operator %q for header %q", string(c.operator), string(c.header))
+}
+
 func (c comparator) Compare(r Record) (bool, error) {
+	if len(c.values) > 0 {
+		for _, v := range c.values {
+			if ok, err := v.Compare(r); err != nil || ok {
+				return ok == (c.operator == OPERATOR_EQUAL_MATCH), err
+			}
+		}
+
+		return c.operator != OPERATOR_EQUAL_MATCH, nil
+	}
+
 	switch c.header {
 	case HEADER_A_SENDER:
 		switch c.operator {
 		case OPERATOR_EQUAL_MATCH:
 			return c.IsMatchingSender(r), nil
+		case OPERATOR_NOT_MATCH:
+			return !c.IsMatchingSender(r), nil
 		default:
-			return false, fmt.Errorf("header a? %v", c.operator)
+			return false, c.unsupportedOperator()
 		}
 	case HEADER_B_RECEIVER:
 		switch c.operator {
 		case OPERATOR_EQUAL_MATCH:
 			return c.IsMatchingReceiver(r), nil
+		case OPERATOR_NOT_MATCH:
+			return !c.IsMatchingReceiver(r), nil
 		default:
-			return false, fmt.Errorf("header b? %v", c.operator)
+			return false, c.unsupportedOperator()
 		}
 	case HEADER_C_CATEGORY:
 		switch c.operator {
 		case OPERATOR_EQUAL_MATCH:
 			return c.IsMatchingLabel(r), nil
+		case OPERATOR_NOT_MATCH:
+			return !c.IsMatchingLabel(r), nil
 		default:
-			return false, fmt.Errorf("header c? %v", c.operator)
+			return false, c.unsupportedOperator()
 		}
 	case HEADER_D_DATE:
 		switch c.operator {
 		case OPERATOR_EQUAL_MATCH:
 			return c.IsMatchingDate(r), nil
+		case OPERATOR_NOT_MATCH:
+			return !c.IsMatchingDate(r), nil
 		case OPERATOR_GREATER_THAN:
 			return c.IsAfterDate(r), nil
 		case OPERATOR_LESS_THAN:
 			return c.IsBeforeDate(r), nil
 		default:
-			return false, fmt.Errorf("header d? %v", c.operator)
+			return false, c.unsupportedOperator()
 		}
 	case HEADER_S_SUM:
 		switch c.operator {
 		case OPERATOR_EQUAL_MATCH:
 			return c.IsMatchingAmount(r), nil
+		case OPERATOR_NOT_MATCH:
+			return !c.IsMatchingAmount(r), nil
 		case OPERATOR_GREATER_THAN:
 			return c.IsGreaterThanAmount(r), nil
 		case OPERATOR_LESS_THAN:
 			return c.IsLessThanAmount(r), nil
 		default:
-			return false, fmt.Errorf("header s? %v", c.operator)
+			return false, c.unsupportedOperator()
+		}
+	case HEADER_V_SIGNED:
+		switch c.operator {
+		case OPERATOR_EQUAL_MATCH:
+			return c.IsMatchingSignedAmount(r), nil
+		case OPERATOR_NOT_MATCH:
+			return !c.IsMatchingSignedAmount(r), nil
+		case OPERATOR_GREATER_THAN:
+			return c.IsGreaterThanSignedAmount(r), nil
+		case OPERATOR_LESS_THAN:
+			return c.IsLessThanSignedAmount(r), nil
+		default:
+			return false, c.unsupportedOperator()
 		}
 	case HEADER_X_ANYONE:
 		switch c.operator {
 		case OPERATOR_EQUAL_MATCH:
 			return c.IsMatchingSenderOrReceiver(r), nil
+		case OPERATOR_NOT_MATCH:
+			return !c.IsMatchingSenderOrReceiver(r), nil
+		default:
+			return false, c.unsupportedOperator()
+		}
+	case HEADER_R_RAW:
+		switch c.operator {
+		case OPERATOR_EQUAL_MATCH:
+			return c.IsMatchingRawLabel(r), nil
+		case OPERATOR_NOT_MATCH:
+			return !c.IsMatchingRawLabel(r), nil
+		default:
+			return false, c.unsupportedOperator()
+		}
+	case HEADER_Y_BOTH:
+		switch c.operator {
+		case OPERATOR_EQUAL_MATCH:
+			return c.IsMatchingSenderAndReceiver(r), nil
+		case OPERATOR_NOT_MATCH:
+			return !c.IsMatchingSenderAndReceiver(r), nil
+		default:
+			return false, c.unsupportedOperator()
+		}
+	case HEADER_N_NEITHER:
+		switch c.operator {
+		case OPERATOR_EQUAL_MATCH:
+			return !c.IsMatchingSenderOrReceiver(r), nil
+		case OPERATOR_NOT_MATCH:
+			return c.IsMatchingSenderOrReceiver(r), nil
+		default:
+			return false, c.unsupportedOperator()
+		}
+	case HEADER_P_SPLIT:
+		switch c.operator {
+		case OPERATOR_EQUAL_MATCH:
+			return r.Split == (c.numberValue == 1), nil
+		case OPERATOR_NOT_MATCH:
+			return r.Split != (c.numberValue == 1), nil
+		default:
+			return false, c.unsupportedOperator()
+		}
+	case HEADER_U_UNKNOWN:
+		switch c.operator {
+		case OPERATOR_EQUAL_MATCH:
+			return c.IsUncategorized(r), nil
+		case OPERATOR_NOT_MATCH:
+			return !c.IsUncategorized(r), nil
 		default:
-			return false, fmt.Errorf("header x? %v", c.operator)
+			return false, c.unsupportedOperator()
+		}
+	case HEADER_G_TAG:
+		switch c.operator {
+		case OPERATOR_EQUAL_MATCH:
+			return c.IsTagged(r), nil
+		case OPERATOR_NOT_MATCH:
+			return !c.IsTagged(r), nil
+		default:
+			return false, c.unsupportedOperator()
+		}
+	case HEADER_W_WEEKDAY:
+		switch c.operator {
+		case OPERATOR_EQUAL_MATCH:
+			return c.IsMatchingWeekday(r), nil
+		case OPERATOR_NOT_MATCH:
+			return !c.IsMatchingWeekday(r), nil
+		default:
+			return false, c.unsupportedOperator()
 		}
 	case HEADER_0_BALANCE:
 		switch c.operator {
@@ -584,31 +2939,78 @@ func (c comparator) Compare(r Record) (bool, error) {
 		case OPERATOR_LESS_THAN:
 			return c.HasDescendingAmount(r), nil
 		default:
-			return false, fmt.Errorf("header z? %v", c.operator)
+			return false, c.unsupportedOperator()
 		}
 	}
 
-	return false, fmt.Errorf("unsupported header: %v", c.header)
+	if c.header == 0 {
+		return false, queryErrorf(ErrUnknownHeader, string(c.bytesValue), "unsupported condition: %q", c.bytesValue)
+	}
+
+	return false, queryErrorf(ErrUnknownHeader, string(c.header), "unsupported header: %q", string(c.header))
 }
 
 var (
-	_FORMULA_REGEX = regexp.MustCompile(`\s*([xzabcds]\s*[=><])\s*(.+)\s*`)
+	_FORMULA_REGEX = regexp.MustCompile(`\s*([xyznwvtgurpabcds]\s*(?:!=|[=><]))\s*(.+)\s*`)
 	_FORMUAL_PARTS = 2
 )
 
 var _DELIM = []byte(";") // (a = alex; s > 5000; ...)
 
+var _ALT = []byte("|") // (a = alex | s > 5000; ...), binds weaker than _DELIM
+
 var (
 	_DATE_REGEX_YYYY_MM_DD    = regexp.MustCompile(`^(\d{4})-(\d{2})-(\d{2})$`)
+	_DATE_REGEX_YYYY_MM       = regexp.MustCompile(`^(\d{4})-(\d{2})$`)
+	_DATE_REGEX_PERIOD_YYYY   = regexp.MustCompile(`^([qh])([1-4])\s+(\d{4})$`) // quarter or half of year
 	_DATE_REGEX_DD_MM_YYYY    = regexp.MustCompile(`^(\d{1,2})[\/\.\-](\d{1,2})[\/\.\-](\d{4})$`)
-	_DATE_REGEX_MONTH_YYYY    = regexp.MustCompile(`^(\w{3,})\s+(\d{4})$`)
-	_DATE_REGEX_DD_MONTH_YYYY = regexp.MustCompile(`^(\d{1,2})\s+(\w{3,})\s+(\d{4})$`)
-	_DATE_REGEX_DD_MONTH      = regexp.MustCompile(`^(\d{1,2})\s+(\w{3,})$`) // consider current year or last year
+	_DATE_REGEX_MONTH_YYYY    = regexp.MustCompile(`^(\p{L}{3,})\s+(\d{4})$`) // letters of any alphabet, e.g. märz
+	_DATE_REGEX_DD_MONTH_YYYY = regexp.MustCompile(`^(\d{1,2})\s+(\p{L}{3,})\s+(\d{4})$`)
+	_DATE_REGEX_DD_MONTH      = regexp.MustCompile(`^(\d{1,2})\s+(\p{L}{3,})$`) // consider current year or last year
 )
 
 const _MIN_YEAR = 1922 // 100 years ago
 
-func prepare(cs *scope, cleanQuery []byte) ([]comparator, error) {
+func relativeDate(keyword string, now time.Time) (first, last time.Time, ok bool) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	firstDayOfMonth := today.AddDate(0, 0, 1-today.Day())
+	firstDayOfYear := time.Date(today.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	switch whitespace.ReplaceAllString(keyword, " ") {
+	case "today":
+		return today, today, true
+	case "yesterday":
+		return today.AddDate(0, 0, -1), today.AddDate(0, 0, -1), true
+	case "this month":
+		return firstDayOfMonth, firstDayOfMonth.AddDate(0, 1, -1), true
+	case "last month":
+		return firstDayOfMonth.AddDate(0, -1, 0), firstDayOfMonth.AddDate(0, 0, -1), true
+	case "this year":
+		return firstDayOfYear, firstDayOfYear.AddDate(1, 0, -1), true
+	case "last year":
+		return firstDayOfYear.AddDate(-1, 0, 0), firstDayOfYear.AddDate(0, 0, -1), true
+	}
+
+	return first, last, false
+}
+
+func prepareAny(cs *scope, lc *Locale, cleanQuery []byte) ([][]comparator, error) {
+	alternatives := bytes.Split(cleanQuery, _ALT)
+	groups := make([][]comparator, 0, len(alternatives))
+
+	for _, alternative := range alternatives {
+		filters, err := prepare(cs, lc, alternative)
+		if err != nil {
+			return nil, err
+		}
+
+		groups = append(groups, filters)
+	}
+
+	return groups, nil
+}
+
+func prepare(cs *scope, locale *Locale, cleanQuery []byte) ([]comparator, error) {
 	conditions := bytes.Split(bytes.TrimSpace(cleanQuery), _DELIM)
 	filters := make([]comparator, 0, len(conditions))
 
@@ -618,25 +3020,90 @@ func prepare(cs *scope, cleanQuery []byte) ([]comparator, error) {
 		}
 
 		var tokens = _FORMULA_REGEX.FindSubmatch(condition)
-		var comp = comparator{intervalScope: cs}
+		var comp = comparator{intervalScope: cs, locale: locale, bytesValue: unescape(condition)}
 
 		if len(tokens) == _FORMUAL_PARTS+1 { // +1 because FindSubmatch includes the string itself
 			field, value := bytes.ReplaceAll(tokens[1], []byte(" "), []byte("")), bytes.ToLower(tokens[2])
 
 			comp.header = field[0]
 			comp.operator = field[1]
-			comp.bytesValue = bytes.TrimSpace(value)
+			comp.bytesValue = unescape(bytes.TrimSpace(value))
+
+			if center, tolerance, ok := cutTolerance(comp.bytesValue); ok && (comp.header == HEADER_S_SUM || comp.header == HEADER_V_SIGNED) {
+				if err := prepareTolerance(&comp, center, tolerance); err != nil {
+					return nil, err
+				}
+
+				filters = append(filters, comp)
+				continue
+			}
+
+			if values := splitValues(comp.header, comp.bytesValue, locale); len(values) > 1 {
+				if comp.operator != OPERATOR_EQUAL_MATCH && comp.operator != OPERATOR_NOT_MATCH {
+					return nil, comp.unsupportedOperator()
+				}
+
+				for _, v := range values {
+					sub, err := prepare(cs, locale, append([]byte{comp.header, OPERATOR_EQUAL_MATCH}, v...))
+					if err != nil {
+						return nil, err
+					}
+
+					comp.values = append(comp.values, sub[0])
+				}
+
+				filters = append(filters, comp)
+				continue
+			}
+
+			if low, high, ok := bytes.Cut(comp.bytesValue, _RANGE); ok && bytes.ContainsRune([]byte{HEADER_D_DATE, HEADER_S_SUM, HEADER_V_SIGNED}, rune(comp.header)) {
+				if err := prepareRange(&comp, low, high); err != nil {
+					return nil, err
+				}
+
+				filters = append(filters, comp)
+				continue
+			}
 
 			switch comp.header {
+			case HEADER_A_SENDER, HEADER_B_RECEIVER, HEADER_C_CATEGORY, HEADER_X_ANYONE, HEADER_Y_BOTH, HEADER_N_NEITHER, HEADER_R_RAW:
+				comp.bytesValue = unescape(bytes.TrimSpace(tokens[2])) // keep case for 'exact' matches
+
+				// regex keep their symbols and backslashes, see hideEscaped
+				if expr := comp.bytesValue; len(expr) > 2 && expr[0] == '/' && expr[len(expr)-1] == '/' {
+					pattern, err := regexp.Compile("(?i)" + string(expr[1:len(expr)-1]))
+					if err != nil {
+						return nil, queryErrorf(ErrInvalidValue, string(expr), "not a regex %s: %v", expr, err)
+					}
+
+					comp.pattern = pattern
+				} else {
+					values := bytes.Split(bytes.TrimSpace(tokens[2]), _TEXT_OR_SEP)
+					for _, v := range values {
+						if v = bytes.TrimSpace(v); len(v) == 0 && len(values) > 1 { // would match everything
+							return nil, queryErrorf(ErrInvalidValue, string(comp.bytesValue), "empty value in %s", comp.bytesValue)
+						} else if len(v) > 1 && v[0] == '\\' && bytes.IndexByte([]byte(_LITERAL), v[1]) > -1 {
+							comp.keywords = append(comp.keywords, keyword{_KW_PREFIX, normalize(locale, string(unescape(v[1:])))})
+						} else {
+							comp.keywords = append(comp.keywords, newKeyword(locale, string(unescape(v))))
+						}
+					}
+				}
 			case HEADER_D_DATE: // order of most likely to be used
-				if dt := _DATE_REGEX_DD_MONTH.FindSubmatch(comp.bytesValue); len(dt) == 3 {
+				if first, last, ok := relativeDate(string(comp.bytesValue), time.Now()); ok {
+					comp.numberValue = first.Unix()
+					comp.offsetValue = last.Unix() - comp.numberValue
+				} else if dt := _DATE_REGEX_DD_MONTH.FindSubmatch(comp.bytesValue); len(dt) == 3 {
 					dayOfMonth, monthName := string(dt[1]), string(dt[2])
 
 					if day, err := strconv.ParseInt(dayOfMonth, 10, 8); err != nil {
-						return nil, fmt.Errorf("not a day %v: %v", dayOfMonth, err)
+						return nil, queryErrorf(ErrInvalidValue, dayOfMonth, "not a day %v: %v", dayOfMonth, err)
 					} else if day > 0 && day < 32 {
 						currentMonthIndex := time.Now().Month()
-						monthIndex := locale.Month(monthName) + 1
+						monthIndex, err := locale.month(monthName)
+						if err != nil {
+							return nil, queryErrorf(ErrInvalidValue, monthName, "%w", err)
+						}
 
 						if monthIndex > 0 {
 							currentYear := time.Now().Year()
@@ -652,11 +3119,14 @@ func prepare(cs *scope, cleanQuery []byte) ([]comparator, error) {
 					dayOfMonth, monthName, fullYear := string(dt[1]), string(dt[2]), string(dt[3])
 
 					if year, err := strconv.ParseInt(fullYear, 10, 16); err != nil {
-						return nil, fmt.Errorf("not a year %v: %v", fullYear, err)
+						return nil, queryErrorf(ErrInvalidValue, fullYear, "not a year %v: %v", fullYear, err)
 					} else if day, err := strconv.ParseInt(dayOfMonth, 10, 8); err != nil {
-						return nil, fmt.Errorf("not a month %v: %v", dayOfMonth, err)
+						return nil, queryErrorf(ErrInvalidValue, dayOfMonth, "not a month %v: %v", dayOfMonth, err)
 					} else if day > 0 && day < 32 {
-						monthIndex := locale.Month(monthName) + 1
+						monthIndex, err := locale.month(monthName)
+						if err != nil {
+							return nil, queryErrorf(ErrInvalidValue, monthName, "%w", err)
+						}
 
 						if monthIndex > 0 {
 							datetime := time.Date(int(year), time.Month(monthIndex), int(day), 0, 0, 0, 0, time.UTC)
@@ -667,9 +3137,12 @@ func prepare(cs *scope, cleanQuery []byte) ([]comparator, error) {
 					monthName, fullYear := string(dt[1]), string(dt[2])
 
 					if year, err := strconv.ParseInt(fullYear, 10, 16); err != nil {
-						return nil, fmt.Errorf("not a year %v: %v", fullYear, err)
+						return nil, queryErrorf(ErrInvalidValue, fullYear, "not a year %v: %v", fullYear, err)
 					} else {
-						monthIndex := locale.Month(monthName) + 1
+						monthIndex, err := locale.month(monthName)
+						if err != nil {
+							return nil, queryErrorf(ErrInvalidValue, monthName, "%w", err)
+						}
 
 						if monthIndex > 0 {
 							firstDayOfMonth := time.Date(int(year), time.Month(monthIndex), 1, 0, 0, 0, 0, time.UTC)
@@ -680,34 +3153,75 @@ func prepare(cs *scope, cleanQuery []byte) ([]comparator, error) {
 
 				} else if dt := _DATE_REGEX_DD_MM_YYYY.FindSubmatch(comp.bytesValue); len(dt) == 4 {
 					dayOfMonth, monthOfYear, fullYear := string(dt[1]), string(dt[2]), string(dt[3])
+					if !OPT_DAY_FIRST {
+						dayOfMonth, monthOfYear = monthOfYear, dayOfMonth
+					}
 
 					if year, err := strconv.ParseInt(fullYear, 10, 16); err != nil {
-						return nil, fmt.Errorf("not a year %v: %v", fullYear, err)
+						return nil, queryErrorf(ErrInvalidValue, fullYear, "not a year %v: %v", fullYear, err)
 					} else if month, err := strconv.ParseInt(monthOfYear, 10, 8); err != nil {
-						return nil, fmt.Errorf("not a month %v: %v", monthOfYear, err)
+						return nil, queryErrorf(ErrInvalidValue, monthOfYear, "not a month %v: %v", monthOfYear, err)
 					} else if day, err := strconv.ParseInt(dayOfMonth, 10, 8); err != nil {
-						return nil, fmt.Errorf("not a day %v: %v", dayOfMonth, err)
-					} else if day >= 1 && day <= 31 && month >= 1 && month <= 12 {
-						datetime := time.Date(int(year), time.Month(month), int(day), 0, 0, 0, 0, time.UTC)
-						comp.numberValue = datetime.Unix()
+						return nil, queryErrorf(ErrInvalidValue, dayOfMonth, "not a day %v: %v", dayOfMonth, err)
+					} else {
+						if month > 12 && day <= 12 {
+							day, month = month, day // not ambiguous, e.g. 13/01 or 01/13
+						}
+
+						if day >= 1 && day <= 31 && month >= 1 && month <= 12 {
+							datetime := time.Date(int(year), time.Month(month), int(day), 0, 0, 0, 0, time.UTC)
+							comp.numberValue = datetime.Unix()
+						}
 					}
 				} else if dt := _DATE_REGEX_YYYY_MM_DD.FindSubmatch(comp.bytesValue); len(dt) == 4 {
 					fullYear, monthOfYear, dayOfMonth := string(dt[1]), string(dt[2]), string(dt[3])
 
 					if year, err := strconv.ParseInt(fullYear, 10, 16); err != nil {
-						return nil, fmt.Errorf("not a year %v: %v", fullYear, err)
+						return nil, queryErrorf(ErrInvalidValue, fullYear, "not a year %v: %v", fullYear, err)
 					} else if month, err := strconv.ParseInt(monthOfYear, 10, 8); err != nil {
-						return nil, fmt.Errorf("not a month %v: %v", monthOfYear, err)
+						return nil, queryErrorf(ErrInvalidValue, monthOfYear, "not a month %v: %v", monthOfYear, err)
 					} else if day, err := strconv.ParseInt(dayOfMonth, 10, 8); err != nil {
-						return nil, fmt.Errorf("not a day %v: %v", dayOfMonth, err)
+						return nil, queryErrorf(ErrInvalidValue, dayOfMonth, "not a day %v: %v", dayOfMonth, err)
 					} else if day >= 1 && day <= 31 && month >= 1 && month <= 12 {
 						datetime := time.Date(int(year), time.Month(month), int(day), 0, 0, 0, 0, time.UTC)
 						comp.numberValue = datetime.Unix()
 					}
+				} else if dt := _DATE_REGEX_YYYY_MM.FindSubmatch(comp.bytesValue); len(dt) == 3 {
+					fullYear, monthOfYear := string(dt[1]), string(dt[2])
+
+					if year, err := strconv.ParseInt(fullYear, 10, 16); err != nil {
+						return nil, queryErrorf(ErrInvalidValue, fullYear, "not a year %v: %v", fullYear, err)
+					} else if month, err := strconv.ParseInt(monthOfYear, 10, 8); err != nil {
+						return nil, queryErrorf(ErrInvalidValue, monthOfYear, "not a month %v: %v", monthOfYear, err)
+					} else if month >= 1 && month <= 12 {
+						firstDayOfMonth := time.Date(int(year), time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+						comp.numberValue = firstDayOfMonth.Unix()
+						comp.offsetValue = firstDayOfMonth.AddDate(0, 1, -1).Unix() - comp.numberValue
+					}
+				} else if dt := _DATE_REGEX_PERIOD_YYYY.FindSubmatch(comp.bytesValue); len(dt) == 4 {
+					months := 3 // quarter
+					if dt[1][0] == 'h' {
+						months = 6
+					}
+
+					if period := int(dt[2][0] - '0'); period*months <= 12 {
+						if year, err := strconv.ParseInt(string(dt[3]), 10, 16); err != nil {
+							return nil, queryErrorf(ErrInvalidValue, string(dt[3]), "not a year %s: %v", dt[3], err)
+						} else {
+							firstDay := time.Date(int(year), time.Month((period-1)*months+1), 1, 0, 0, 0, 0, time.UTC)
+							comp.numberValue = firstDay.Unix()
+							comp.offsetValue = firstDay.AddDate(0, months, -1).Unix() - comp.numberValue
+						}
+					}
 				} else {
 					var maybeMonthName = string(comp.bytesValue)
 
-					if monthIndex := locale.Month(maybeMonthName); monthIndex > -1 {
+					monthIndex, err := locale.LookupMonth(maybeMonthName)
+					if errors.Is(err, ErrAmbiguousMonth) {
+						return nil, queryErrorf(ErrInvalidValue, maybeMonthName, "%w", err)
+					}
+
+					if monthIndex > -1 {
 						currentMonthIndex := time.Now().Month()
 						currentYear := time.Now().Year()
 						month := monthIndex + 1 // golang starts at 1
@@ -719,6 +3233,10 @@ func prepare(cs *scope, cleanQuery []byte) ([]comparator, error) {
 						firstDayOfMonth := time.Date(currentYear, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
 						comp.numberValue = firstDayOfMonth.Unix()
 						comp.offsetValue = firstDayOfMonth.AddDate(0, 1, -1).Unix() - comp.numberValue
+
+						if OPT_ANY_YEAR {
+							comp.month = time.Month(month) // before and after still use the last one
+						}
 					} else if len(comp.bytesValue) == 4 { // maybe it's just an year
 						if year, err := strconv.ParseInt(string(comp.bytesValue), 10, 16); err == nil {
 							currentYear := time.Now().Year()
@@ -731,33 +3249,51 @@ func prepare(cs *scope, cleanQuery []byte) ([]comparator, error) {
 						}
 					}
 				}
-			case HEADER_S_SUM: // it can be 10 as in 10,00 RON or 10,50 RON
-				var sumText, maxText string
-
-				if bytes.Contains(comp.bytesValue, []byte(",")) {
-					sumText = string(bytes.ReplaceAll(value, []byte(","), []byte("")))
+			case HEADER_S_SUM, HEADER_V_SIGNED:
+				// sums compare the absolute amount, e.g. 10 as in 10,00 RON or 10,50 RON, so s>1000
+				// is any transfer over 1000; signed sums keep the sign, e.g. -10 as in -10,00 RON,
+				// and a negative sum is a signed sum too: s<-1000 is the same as v<-1000, i.e.
+				// expenses over 1000 or (s>1000; z<0), while s>-1000 is all the others
+				sum, offset, err := parseSum(bytes.TrimPrefix(comp.bytesValue, []byte("-")), locale)
+				if err != nil {
+					return nil, err
+				} else if comp.bytesValue[0] == '-' {
+					comp.header, comp.numberValue, comp.offsetValue = HEADER_V_SIGNED, -sum, offset
 				} else {
-					sumText = string(comp.bytesValue) + "00" // add remaining 2 decimals
-					maxText = string(comp.bytesValue) + "99" // max digits value
+					comp.numberValue, comp.offsetValue = sum, offset
 				}
-
-				if sum, err := strconv.ParseInt(sumText, 10, 64); err != nil {
-					return nil, fmt.Errorf("not an amount %v: %v", sumText, err)
+			case HEADER_W_WEEKDAY:
+				dayName := string(comp.bytesValue)
+				if weekday := locale.Weekday(dayName); weekday == -1 {
+					return nil, queryErrorf(ErrInvalidValue, dayName, "not a weekday %v", dayName)
 				} else {
-					if maxText != "" {
-						if max, err := strconv.ParseInt(maxText, 10, 64); err != nil {
-							return nil, fmt.Errorf("not an amount %v: %v", maxText, err)
-						} else {
-							comp.offsetValue = max - sum
-						}
-					}
+					comp.numberValue = int64(weekday)
+				}
+			case HEADER_P_SPLIT:
+				if value, err := strconv.ParseBool(string(comp.bytesValue)); err != nil {
+					return nil, queryErrorf(ErrInvalidValue, string(comp.bytesValue), "not a boolean %s", comp.bytesValue)
+				} else if value {
+					comp.numberValue = 1
+				}
+			case HEADER_U_UNKNOWN:
+				if value := string(comp.bytesValue); value != _UNKNOWN_VALUE && !strings.EqualFold(value, _EMPTY_VALUE) {
+					return nil, queryErrorf(ErrInvalidValue, value, "not an unknown value %v", value)
+				}
+			case HEADER_T_TYPE: // rewritten as a balance condition
+				value := strings.ToLower(string(comp.bytesValue))
+				if value != "income" && value != "expense" {
+					return nil, queryErrorf(ErrInvalidValue, value, "not a transaction type %v", value)
+				} else if comp.operator != OPERATOR_EQUAL_MATCH {
+					return nil, comp.unsupportedOperator()
+				}
 
-					comp.numberValue = sum
+				if comp.header, comp.operator = HEADER_0_BALANCE, OPERATOR_GREATER_THAN; value == "expense" {
+					comp.operator = OPERATOR_LESS_THAN
 				}
 			case HEADER_0_BALANCE:
 				value := string(comp.bytesValue)
 				if val, err := strconv.ParseInt(value, 10, 32); err != nil {
-					return nil, fmt.Errorf("not a number %v: %v", value, err)
+					return nil, queryErrorf(ErrInvalidValue, value, "not a number %v: %v", value, err)
 				} else {
 					comp.numberValue = val // mostly used to compare against 0, "is it positive or negative?" wrt balance
 				}
@@ -770,20 +3306,209 @@ func prepare(cs *scope, cleanQuery []byte) ([]comparator, error) {
 	return filters, nil
 }
 
-func query(records Collection, filters []comparator) (Collection, error) {
+var _TOLERANCE = [][]byte{[]byte("±"), []byte("+/-")} // (s = 100 ± 5), (v = -100 +/- 0,50)
+
+func cutTolerance(value []byte) (center, tolerance []byte, ok bool) {
+	for _, sep := range _TOLERANCE {
+		if center, tolerance, ok = bytes.Cut(value, sep); ok {
+			return bytes.TrimSpace(center), bytes.TrimSpace(tolerance), true
+		}
+	}
+
+	return nil, nil, false
+}
+
+// prepareTolerance matches amounts within center ± tolerance, both ends are
+// included whatever the brackets
+func prepareTolerance(comp *comparator, center, tolerance []byte) error {
+	if comp.operator != OPERATOR_EQUAL_MATCH && comp.operator != OPERATOR_NOT_MATCH {
+		return comp.unsupportedOperator()
+	}
+
+	var sign int64 = 1
+	if bytes.HasPrefix(center, []byte("-")) { // a negative sum is a signed sum, same as without tolerance
+		sign, center, comp.header = -1, center[1:], HEADER_V_SIGNED
+	}
+
+	sum, _, err := parseSum(center, comp.locale)
+	if err != nil {
+		return err
+	}
+
+	delta, _, err := parseSum(tolerance, comp.locale)
+	if err != nil {
+		return err
+	}
+
+	comp.numberValue, comp.offsetValue = sign*sum-delta, 2*delta
+	comp.intervalScope, comp.isRange = &scope{true, true}, true
+
+	return nil
+}
+
+// splitValues splits dates and amounts separated by commas; a comma followed
+// by at most OPT_AMOUNT_SCALE digits is a decimal comma, e.g. 27,73 or 40,2
+// but not 1000,9000 or 10, 20
+func splitValues(header byte, value []byte, lc *Locale) [][]byte {
+	if header == HEADER_D_DATE {
+		return bytes.Split(value, _TEXT_OR_SEP)
+	} else if header != HEADER_S_SUM && header != HEADER_V_SIGNED {
+		return nil
+	}
+
+	decimal, _ := lc.separators()
+
+	var values [][]byte
+	var start int
+	for i, chr := range value {
+		if chr != ',' {
+			continue
+		}
+
+		digits := i + 1
+		for digits < len(value) && value[digits] >= '0' && value[digits] <= '9' {
+			digits++
+		}
+
+		if n := digits - i - 1; decimal == "." || n == 0 || decimal != "," && n > OPT_AMOUNT_SCALE {
+			values = append(values, bytes.TrimSpace(value[start:i]))
+			start = i + 1
+		}
+	}
+
+	return append(values, bytes.TrimSpace(value[start:]))
+}
+
+var _RANGE = []byte("..") // (s = 100..500), (d = 2019-01-01..2019-12-31)
+
+// prepareRange reads both ends as if they were written "low < x < high" so the
+// range matches the two-condition query with the same brackets
+func prepareRange(comp *comparator, low, high []byte) error {
+	if comp.operator != OPERATOR_EQUAL_MATCH && comp.operator != OPERATOR_NOT_MATCH {
+		return comp.unsupportedOperator()
+	}
+
+	lows, err := prepare(comp.intervalScope, comp.locale, append([]byte{comp.header, OPERATOR_GREATER_THAN}, bytes.TrimSpace(low)...))
+	if err != nil {
+		return err
+	}
+
+	highs, err := prepare(comp.intervalScope, comp.locale, append([]byte{comp.header, OPERATOR_LESS_THAN}, bytes.TrimSpace(high)...))
+	if err != nil {
+		return err
+	}
+
+	if lows[0].header == HEADER_V_SIGNED || highs[0].header == HEADER_V_SIGNED {
+		comp.header = HEADER_V_SIGNED // a negative sum is a signed sum, e.g. s=-500..-100
+	}
+
+	lower, upper := lows[0].numberValue, highs[0].numberValue
+	if comp.header == HEADER_D_DATE { // dates such as "march 2020" cover more than a day
+		if !comp.intervalScope.isLeftInclusive {
+			lower += lows[0].offsetValue
+		}
+
+		if comp.intervalScope.isRightInclusive {
+			upper += highs[0].offsetValue
+		}
+	}
+
+	comp.numberValue, comp.offsetValue, comp.isRange = lower, upper-lower, true
+	return nil
+}
+
+func parseSum(value []byte, lc *Locale) (sum, offset int64, err error) {
+	var sumText, maxText string
+
+	var sep = []byte(",") // same as amounts in csv, queries use a decimal comma by default
+	if decimal, grouping := lc.separators(); decimal != "" {
+		sep = []byte(decimal)
+		if grouping != "" {
+			value = bytes.ReplaceAll(value, []byte(grouping), nil)
+		}
+	}
+
+	if whole, fraction, ok := bytes.Cut(value, sep); ok {
+		if len(fraction) > OPT_AMOUNT_SCALE {
+			return 0, 0, queryErrorf(ErrInvalidValue, string(value), "too many decimals %q", value)
+		}
+
+		sumText = string(whole) + string(fraction) + strings.Repeat("0", OPT_AMOUNT_SCALE-len(fraction))
+	} else {
+		sumText = string(value) + strings.Repeat("0", OPT_AMOUNT_SCALE) // add remaining decimals
+		maxText = string(value) + strings.Repeat("9", OPT_AMOUNT_SCALE) // max digits value
+	}
+
+	if sum, err = strconv.ParseInt(sumText, 10, 64); err != nil {
+		return 0, 0, queryErrorf(ErrInvalidValue, string(value), "not an amount %v: %v", sumText, err)
+	}
+
+	if maxText != "" {
+		if max, err := strconv.ParseInt(maxText, 10, 64); err != nil {
+			return 0, 0, queryErrorf(ErrInvalidValue, string(value), "not an amount %v: %v", maxText, err)
+		} else {
+			offset = max - sum
+		}
+	}
+
+	return sum, offset, nil
+}
+
+const _CHECK_CONTEXT = 1024 // records between checks for cancellation
+
+func query(ctx context.Context, records Collection, filters []comparator) (Collection, error) {
 	if len(records) == 0 || len(filters) == 0 {
 		return records, nil
 	}
 
-	var newRecords = make([]Record, 0)
-	for _, record := range records {
-		if ok, err := filters[0].Compare(record); err != nil {
-			return nil, err
-		} else if ok {
+	var newRecords = make([]Record, 0, len(records))
+	for i, record := range records {
+		if i%_CHECK_CONTEXT == _CHECK_CONTEXT-1 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		matching := true
+		for _, filter := range filters {
+			if ok, err := filter.Compare(record); err != nil {
+				return nil, err
+			} else if !ok {
+				matching = false
+				break // no need to check the other conditions
+			}
+		}
+
+		if matching {
 			newRecords = append(newRecords, record)
 		}
+	}
+
+	return newRecords, nil
+}
+
+func queryAny(ctx context.Context, records Collection, groups [][]comparator) (Collection, error) {
+	if len(groups) == 1 {
+		return query(ctx, records, groups[0])
+	}
+
+	var newRecords = make([]Record, 0)
+	for i, record := range records {
+		if i%_CHECK_CONTEXT == _CHECK_CONTEXT-1 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
 
+		for _, filters := range groups {
+			if out, err := query(ctx, Collection{record}, filters); err != nil {
+				return nil, err
+			} else if len(out) == 1 {
+				newRecords = append(newRecords, record)
+				break
+			}
+		}
 	}
 
-	return query(newRecords, filters[1:])
+	return newRecords, nil
 }
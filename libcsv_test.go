@@ -20,10 +20,22 @@
 package libcsv
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 func TestReadingIncorrectAddup(t *testing.T) {
@@ -56,6 +68,53 @@ func TestReadingIncorrectAmount(t *testing.T) {
 	New(strings.NewReader(`a,b,118 Casă și curățenie + 16.15 Alimente,2019-12-05,-27x73`))
 }
 
+func TestReadingSafely(t *testing.T) {
+	if _, err := NewSafe(strings.NewReader(`a,b,c,2019'12'05,100`)); err == nil {
+		t.Error("expected to fail on date but didn't")
+	} else if !strings.HasPrefix(err.Error(), "row 1, column 3:") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if _, err := NewSafe(strings.NewReader("a,b,c,2019-12-05,100\na,b,c,2019-12-05,1x0")); err == nil {
+		t.Error("expected to fail on amount but didn't")
+	} else if !strings.HasPrefix(err.Error(), "row 2, column 4:") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if all, err := NewSafe(strings.NewReader(`a,b,c,2019-12-05,100`)); err != nil {
+		t.Error(err)
+	} else if len(all) != 1 {
+		t.Errorf("expected one record but got %v", len(all))
+	}
+}
+
+func TestReadingMissingColumns(t *testing.T) {
+	if _, err := NewSafe(strings.NewReader(`a,b,c`)); err == nil {
+		t.Error("expected to fail on missing columns but didn't")
+	} else if err.Error() != "row 1 has 3 columns, expected at least 5" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestReadingMixedDateLayouts(t *testing.T) {
+	mixed := "a,b,c,2019-12-05,100\na,b,c,06.12.2019,200"
+
+	if _, err := NewSafe(strings.NewReader(mixed)); err == nil {
+		t.Error("expected to fail on second date layout but didn't")
+	}
+
+	OPT_DATE_FALLBACK_LAYOUTS = []string{"02/01/2006", "02.01.2006"}
+	defer func() { OPT_DATE_FALLBACK_LAYOUTS = []string{} }()
+
+	if all, err := NewSafe(strings.NewReader(mixed)); err != nil {
+		t.Error(err)
+	} else if len(all) != 2 {
+		t.Errorf("expected two records but got %v", len(all))
+	} else if !all[1].Date.Equal(time.Date(2019, time.December, 6, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected date %v", all[1].Date)
+	}
+}
+
 func TestNothingToDo(t *testing.T) {
 	if all := New(strings.NewReader(`a,b,c,2019-12-05,100`)); len(all) == 1 {
 		if out, _ := all.Filter(""); len(out) != 1 {
@@ -110,6 +169,105 @@ func TestReadingCSV(t *testing.T) {
 	}
 }
 
+func TestReadingSemicolonCSV(t *testing.T) {
+	expected := New(strings.NewReader(sample))
+
+	OPT_DELIMITER = ';'
+	defer func() { OPT_DELIMITER = ',' }()
+
+	all := New(strings.NewReader(strings.ReplaceAll(sample, ",", ";")))
+	if len(all) != 42 {
+		t.Errorf("doesn't match nr of records %v\n", len(all))
+	}
+
+	for i, each := range expected {
+		if each.String() != all[i].String() {
+			t.Errorf("record %v doesn't match %v", all[i], each)
+		}
+	}
+}
+
+func TestReadingCSVWithHeader(t *testing.T) {
+	OPT_SKIP_HEADER = true
+	defer func() { OPT_SKIP_HEADER = false }()
+
+	all := New(strings.NewReader("sender,receiver,label,date,amount" + sample))
+	if len(all) != 42 {
+		t.Errorf("doesn't match nr of records %v\n", len(all))
+	}
+
+	for _, each := range all {
+		if each.Sender == "sender" || each.Label == "label" {
+			t.Errorf("header turned into record %v", each)
+		}
+	}
+}
+
+func TestReadingCustomLayout(t *testing.T) {
+	var reordered strings.Builder
+	for _, line := range strings.Split(strings.TrimSpace(sample), "\n") {
+		cols := strings.Split(line, ",")
+		fmt.Fprintf(&reordered, "%v,%v,%v,%v,%v\n", cols[3], cols[4], cols[0], cols[1], cols[2])
+	}
+
+	layout := ColumnLayout{Date: 0, Amount: 1, Sender: 2, Receiver: 3, Label: 4}
+	all, err := NewWithLayout(strings.NewReader(reordered.String()), layout)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(all) != 42 {
+		t.Errorf("doesn't match nr of records %v\n", len(all))
+	}
+
+	for i, each := range New(strings.NewReader(sample)) {
+		if each.String() != all[i].String() {
+			t.Errorf("record %v doesn't match %v", all[i], each)
+		}
+	}
+
+	if _, err := NewWithLayout(strings.NewReader(reordered.String()), ColumnLayout{Label: 5}); err == nil {
+		t.Error("expected to fail on missing columns but didn't")
+	}
+}
+
+func TestReadingStream(t *testing.T) {
+	all := New(strings.NewReader(sample))
+	next := NewStream(strings.NewReader(sample))
+
+	var i int
+	for ; ; i++ {
+		record, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		} else if i >= len(all) || record.String() != all[i].String() {
+			t.Fatalf("streamed record %v doesn't match", record)
+		}
+	}
+
+	if i != len(all) {
+		t.Errorf("expected %v streamed records but got %v", len(all), i)
+	}
+}
+
+func TestReadingOverLimit(t *testing.T) {
+	if _, err := NewWithLimit(strings.NewReader(sample), 100); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected to fail because of limit but got %v", err)
+	}
+
+	if all, err := NewWithLimit(strings.NewReader(sample), 0); err != nil {
+		t.Error(err)
+	} else if len(all) != 42 {
+		t.Errorf("doesn't match nr of records %v\n", len(all))
+	}
+
+	if all, err := NewWithLimit(strings.NewReader(sample), int64(len(sample))); err != nil {
+		t.Error(err)
+	} else if len(all) != 42 {
+		t.Errorf("doesn't match nr of records %v\n", len(all))
+	}
+}
+
 var collection = New(strings.NewReader(sample))
 
 func TestVariousStringFilters(t *testing.T) {
@@ -207,29 +365,58 @@ func TestVariousReceivers(t *testing.T) {
 
 func TestWrongQueryFormulas(t *testing.T) {
 	var err error
+	var qe *QueryError
 
 	_, err = collection.Filter(`[b=(magazin)]`)
-	if err.Error() != "unsupported nested paranthesis in b=(magazin" {
+	if err.Error() != "unsupported nested paranthesis in b=(magazin" || !errors.Is(err, ErrNestedParens) {
 		t.Errorf("expected fail but got %v", err)
+	} else if !errors.As(err, &qe) || qe.Token != "b=(magazin" {
+		t.Errorf("unexpected token in %v", err)
 	}
 
 	_, err = collection.Filter(`[b=(magazin]`)
-	if err.Error() != "number of opened paranthesis don't match with closed ones" {
+	if err.Error() != "number of opened paranthesis don't match with closed ones" || !errors.Is(err, ErrUnbalancedParens) {
 		t.Errorf("expected fail but got %v", err)
 	}
 
 	_, err = collection.Filter(`[b=magazin)]`)
-	if err.Error() != "number of opened paranthesis don't match with closed ones" {
+	if err.Error() != "number of opened paranthesis don't match with closed ones" || !errors.Is(err, ErrUnbalancedParens) {
 		t.Errorf("expected fail but got %v", err)
 	}
 
 	_, err = collection.Filter(`[b=magazin) + [x=orice]]`)
-	if err.Error() != "number of opened paranthesis don't match with closed ones" {
+	if err.Error() != "number of opened paranthesis don't match with closed ones" || !errors.Is(err, ErrUnbalancedParens) {
 		t.Errorf("expected fail but got %v", err)
+	} else if !errors.As(err, &qe) || qe.Token != "[b=magazin) + [x=orice]]" {
+		t.Errorf("unexpected token in %v", err)
 	}
 
 	_, err = collection.Filter(`[b=magazin) + [x=[orice]]`)
-	if err.Error() != "unsupported nested paranthesis in x=[orice" {
+	if err.Error() != "unsupported nested paranthesis in x=[orice" || !errors.Is(err, ErrNestedParens) {
+		t.Errorf("expected fail but got %v", err)
+	}
+
+	_, err = collection.Filter(`[] * []`)
+	if !errors.Is(err, ErrUnsupportedOperator) {
+		t.Errorf("expected fail but got %v", err)
+	} else if !errors.As(err, &qe) || qe.Token != "*" {
+		t.Errorf("unexpected token in %v", err)
+	}
+
+	_, err = collection.Filter(`[a>alex]`)
+	if !errors.Is(err, ErrUnsupportedOperator) {
+		t.Errorf("expected fail but got %v", err)
+	} else if !errors.As(err, &qe) || qe.Token != ">" {
+		t.Errorf("unexpected token in %v", err)
+	}
+
+	_, err = collection.Filter(`[d:x]`)
+	if !errors.Is(err, ErrUnknownHeader) {
+		t.Errorf("expected fail but got %v", err)
+	}
+
+	_, err = collection.Filter(`+[]`)
+	if !errors.Is(err, ErrIncorrectQuery) {
 		t.Errorf("expected fail but got %v", err)
 	}
 }
@@ -360,7 +547,7 @@ func TestVariousDateLookups(t *testing.T) {
 	// dd month
 	present := time.Now()
 	now := time.Date(present.Year(), present.Month(), present.Day(), 0, 0, 0, 0, time.UTC)
-	collection2 := append(collection, Record{"a", "b", "c", now, 100})
+	collection2 := append(collection.Clone(), Record{Sender: "a", Receiver: "b", Label: "c", Date: now, Amount: 100})
 	currentMonth := int(now.Month())
 	currentMonthLocale := calendar[currentMonth-1]
 	formula := fmt.Sprintf("[d = %v %v]", now.Day(), currentMonthLocale)
@@ -497,32 +684,32 @@ func TestVariousIncorrectFormulas(t *testing.T) {
 	}
 
 	_, err = collection.Filter("[a>alex]")
-	if err.Error() != "header a? 62" {
+	if err.Error() != `unsupported operator ">" for header "a"` {
 		t.Error("expected fail but didn't")
 	}
 
 	_, err = collection.Filter("[b>alex]")
-	if err.Error() != "header b? 62" {
+	if err.Error() != `unsupported operator ">" for header "b"` {
 		t.Error("expected fail but didn't")
 	}
 
 	_, err = collection.Filter("[c>alex]")
-	if err.Error() != "header c? 62" {
+	if err.Error() != `unsupported operator ">" for header "c"` {
 		t.Error("expected fail but didn't")
 	}
 
 	_, err = collection.Filter("[x>alex]")
-	if err.Error() != "header x? 62" {
+	if err.Error() != `unsupported operator ">" for header "x"` {
 		t.Error("expected fail but didn't")
 	}
 
 	_, err = collection.Filter("[z=0]")
-	if err.Error() != "header z? 61" {
+	if err.Error() != `unsupported operator "=" for header "z"` {
 		t.Error("expected fail but didn't")
 	}
 
 	_, err = collection.Filter("[d:x]")
-	if err.Error() != "unsupported header: 0" {
+	if err.Error() != `unsupported condition: "d:x"` {
 		t.Error("expected fail but didn't")
 	}
 }
@@ -567,3 +754,2934 @@ func TestVariousFilters(t *testing.T) {
 		}
 	}
 }
+
+func TestSum(t *testing.T) {
+	if sum := collection.Sum(); sum != 46_889_42 {
+		t.Errorf("unexpected sum %v", sum)
+	}
+
+	if rs, _ := collection.Filter("[a=alex]"); rs.Sum() != -63_695_50 {
+		t.Errorf("unexpected sum %v", rs.Sum())
+	}
+
+	if sum := (Collection{}).Sum(); sum != 0 {
+		t.Errorf("unexpected sum %v", sum)
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	if groups, err := collection.GroupBy(HEADER_B_RECEIVER); err != nil {
+		t.Error(err)
+	} else if len(groups) != 14 {
+		t.Errorf("unexpected nr of groups %v", len(groups))
+	} else {
+		expected := map[string]int64{
+			"(hypermarket)": -893_56,
+			"(magazin)":     -1768_37,
+			"(dentist)":     -2200_00,
+			"Catrina":       98499_99,
+			"Alexandru":     11000_00,
+		}
+
+		for receiver, sum := range expected {
+			if groups[receiver] != sum {
+				t.Errorf("unexpected sum for %v: %v", receiver, groups[receiver])
+			}
+		}
+	}
+
+	if groups, err := collection.GroupBy(HEADER_D_DATE); err != nil {
+		t.Error(err)
+	} else if groups["2020-01-10"] != -514_83 {
+		t.Errorf("unexpected sum for date: %v", groups["2020-01-10"])
+	}
+
+	if _, err := collection.GroupBy(HEADER_S_SUM); err == nil {
+		t.Error("expected group by sum to fail but didn't")
+	}
+}
+
+func TestNegatedConditions(t *testing.T) {
+	if rs, _ := collection.Filter("[a!=alex]"); len(rs) != 10 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	} else {
+		for _, each := range rs {
+			if strings.HasPrefix(strings.ToLower(each.Sender), "alex") {
+				t.Errorf("record has unexpected sender")
+			}
+		}
+	}
+
+	if rs, _ := collection.Filter("[a != alex,catrina]"); len(rs) != 4 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if rs, _ := collection.Filter("[c!=alimente]"); len(rs) != 35 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	} else {
+		for _, each := range rs {
+			if each.Label == "Alimente" {
+				t.Errorf("record has unexpected label")
+			}
+		}
+	}
+
+	if rs, _ := collection.Filter("[x!=catrina]"); len(rs) != 34 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if rs, _ := collection.Filter("[s!=1000]"); len(rs) != 39 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+}
+
+func TestAlternativeConditions(t *testing.T) {
+	if rs, _ := collection.Filter("(a=alex | s>1000)"); len(rs) != 34 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if rs, _ := collection.Filter(`[a=alex; c=alimente | b="Catrina"]`); len(rs) != 7 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	} else {
+		for _, each := range rs {
+			if each.Receiver == "Catrina" || each.Sender == "Alexandru" && each.Label == "Alimente" {
+				continue
+			}
+
+			t.Errorf("record doesn't match any alternative %v", each)
+		}
+	}
+
+	if rs, _ := collection.Filter("[a=ordonator,catrina | c=cafea]"); len(rs) != 11 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+}
+
+func TestIntersection(t *testing.T) {
+	expected, _ := collection.Filter("[a=alex; c=alimente]")
+
+	if rs, err := collection.Filter("[a=alex] & [c=alimente]"); err != nil {
+		t.Error(err)
+	} else if len(rs) != len(expected) || len(rs) != 5 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	} else {
+		for i, each := range rs {
+			if each.String() != expected[i].String() {
+				t.Errorf("record %v doesn't match %v", each, expected[i])
+			}
+		}
+	}
+
+	if rs, _ := collection.Filter("[a=catrina] & [b=catrina]"); len(rs) != 0 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+}
+
+func TestContainingText(t *testing.T) {
+	if rs, _ := collection.Filter("[b=*market*]"); len(rs) != 16 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	} else {
+		for _, each := range rs {
+			if each.Receiver != "(hypermarket)" && each.Receiver != "(supermarket)" {
+				t.Errorf("record doesn't have expected receiver")
+			}
+		}
+	}
+
+	if rs, _ := collection.Filter("[c=dentist]"); len(rs) != 0 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if rs, _ := collection.Filter("[c=*DENTIST*]"); len(rs) != 4 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if rs, _ := collection.Filter("[b=*de alim*,*cafe*]"); len(rs) != 2 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+}
+
+func TestRegexText(t *testing.T) {
+	if rs, err := collection.Filter("[c=/alim.*/]"); err != nil {
+		t.Error(err)
+	} else if len(rs) != 7 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	// escaped parenthesis are literal, unescaped ones are a group
+	if rs, err := collection.Filter(`[b=/^\(\w+market\)$/]`); err != nil || len(rs) != 16 {
+		t.Errorf("unexpected results %d, %v", len(rs), err)
+	} else if rs, err := collection.Filter(`[b=/^\((super|hyper)market\)$/]`); err != nil || len(rs) != 16 {
+		t.Errorf("unexpected results %d, %v", len(rs), err)
+	} else if rs, err := collection.Filter(`[b=/^(\w+market)$/]`); err != nil || len(rs) != 0 {
+		t.Errorf("unexpected results %d, %v", len(rs), err)
+	}
+
+	if rs, _ := collection.Filter(`[b=/market.$/]`); len(rs) != 16 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if rs, _ := collection.Filter(`[a=/^\D{7}$/]`); len(rs) != 6 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if _, err := collection.Filter("[c=/+alim/]"); err == nil || !strings.HasPrefix(err.Error(), "not a regex") {
+		t.Errorf("expected invalid regex to fail but got %v", err)
+	}
+}
+
+func TestDifferenceIsDeterministic(t *testing.T) {
+	expected, _ := collection.Filter("[] - [a=ordonator]")
+	if len(expected) != 38 {
+		t.Fatalf("unexpected nr of results %d\n", len(expected))
+	}
+
+	for i := 0; i < 50; i++ {
+		rs, _ := collection.Filter("[] - [a=ordonator]")
+		for j, each := range rs {
+			if each.String() != expected[j].String() {
+				t.Fatalf("unexpected order at %v: %v", j, each)
+			}
+		}
+	}
+}
+
+func TestConcurrentLocaleSetup(t *testing.T) {
+	defer Setup(CurrentLocale())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			Setup(&Locale{Months: calendar, Unicode: map[string]string{"î": "i"}})
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := collection.Filter("[c=imprumut] + [d=noiembrie 2019]"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestFilterWithLocale(t *testing.T) {
+	ro := &Locale{Months: calendar}
+	en := &Locale{Months: []string{
+		"january", "february", "march", "april", "may", "june",
+		"july", "august", "september", "october", "november", "december",
+	}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if rs, _ := collection.FilterWithLocale("[d=noiembrie 2019]", ro); len(rs) != 9 {
+				t.Errorf("unexpected nr of results %d\n", len(rs))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if rs, _ := collection.FilterWithLocale("[d=november 2019]", en); len(rs) != 9 {
+				t.Errorf("unexpected nr of results %d\n", len(rs))
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// english names are a fallback for every locale
+	if rs, _ := collection.FilterWithLocale("[d=november 2019]", ro); len(rs) != 9 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if rs, _ := collection.FilterWithLocale("[d=noiembrie 2019]", en); len(rs) != 0 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+}
+
+func TestRecordJSON(t *testing.T) {
+	out, err := json.Marshal(collection[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"sender":"Alexandru","receiver":"(hypermarket)","label":"Apa","date":"2019-10-03T00:00:00Z","amount":-3043}`
+	if string(out) != expected {
+		t.Errorf("unexpected json %s", out)
+	}
+
+	var decoded []map[string]interface{}
+	if out, err := json.Marshal(collection[:2]); err != nil {
+		t.Error(err)
+	} else if err := json.Unmarshal(out, &decoded); err != nil {
+		t.Error(err)
+	} else if len(decoded) != 2 || decoded[1]["label"] != "?" || decoded[1]["amount"] != float64(-34900) {
+		t.Errorf("unexpected decoded json %v", decoded)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := collection.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if line, _ := buf.ReadString('\n'); line != "Alexandru,(hypermarket),Apa,2019-10-03,-30.43\n" {
+		t.Errorf("unexpected first line %q", line)
+	}
+
+	buf.Reset()
+	collection.WriteCSV(&buf)
+
+	all := New(&buf)
+	if len(all) != len(collection) {
+		t.Fatalf("doesn't match nr of records %v\n", len(all))
+	}
+
+	for i, each := range collection {
+		if each.String() != all[i].String() {
+			t.Errorf("record %v doesn't match %v", all[i], each)
+		}
+	}
+
+	escaped := New(strings.NewReader(`a,b,10.00 A\+ fee + 5.00 other,2019-12-05,-15.00` + "\na,b,C\\+\\+ books,2019-12-06,-20.00\n"))
+
+	buf.Reset()
+	if err := escaped.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(buf.String(), `A\+ fee`) {
+		t.Errorf("expected the separator to be escaped in %s", buf.String())
+	}
+
+	again, err := NewSafe(&buf)
+	if err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(again) != fmt.Sprint(escaped) || again[0].Label != "A+ fee" || again[2].Label != "C++ books" {
+		t.Errorf("unexpected records %v instead of %v", again, escaped)
+	}
+}
+
+func TestRelativeDates(t *testing.T) {
+	present := time.Now()
+	today := time.Date(present.Year(), present.Month(), present.Day(), 0, 0, 0, 0, time.UTC)
+	firstDayOfMonth := today.AddDate(0, 0, 1-today.Day())
+	lastMonth := firstDayOfMonth.AddDate(0, -1, 0)
+
+	recent := Collection{
+		{Sender: "a", Receiver: "b", Label: "today", Date: today, Amount: 100},
+		{Sender: "a", Receiver: "b", Label: "yesterday", Date: today.AddDate(0, 0, -1), Amount: 100},
+		{Sender: "a", Receiver: "b", Label: "this month", Date: firstDayOfMonth, Amount: 100},
+		{Sender: "a", Receiver: "b", Label: "last month", Date: lastMonth.AddDate(0, 0, 3), Amount: 100},
+		{Sender: "a", Receiver: "b", Label: "last year", Date: time.Date(today.Year()-1, time.June, 15, 0, 0, 0, 0, time.UTC), Amount: 100},
+	}
+
+	expectations := map[string]func(d time.Time) bool{
+		"[d=today]":     func(d time.Time) bool { return d.Equal(today) },
+		"[d=yesterday]": func(d time.Time) bool { return d.Equal(today.AddDate(0, 0, -1)) },
+		"[d=this month]": func(d time.Time) bool {
+			return d.Year() == today.Year() && d.Month() == today.Month()
+		},
+		"[d=last month]": func(d time.Time) bool {
+			return d.Year() == lastMonth.Year() && d.Month() == lastMonth.Month()
+		},
+		"[d=this year]":    func(d time.Time) bool { return d.Year() == today.Year() },
+		"[d=last  year]":   func(d time.Time) bool { return d.Year() == today.Year()-1 },
+		"(d > last month]": func(d time.Time) bool { return !d.Before(firstDayOfMonth) },
+		"[d < yesterday)":  func(d time.Time) bool { return d.Before(today.AddDate(0, 0, -1)) },
+	}
+
+	for query, matches := range expectations {
+		var expected int
+		for _, each := range recent {
+			if matches(each.Date) {
+				expected++
+			}
+		}
+
+		if rs, err := recent.Filter(query); err != nil {
+			t.Error(err)
+		} else if len(rs) != expected {
+			t.Errorf("unexpected nr of results for %v: %d\n", query, len(rs))
+		}
+	}
+}
+
+func TestWeekdays(t *testing.T) {
+	if rs, err := collection.Filter("[w=saturday]"); err != nil {
+		t.Error(err)
+	} else if len(rs) != 5 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	} else {
+		for _, each := range rs {
+			if each.Date.Weekday() != time.Saturday {
+				t.Errorf("unexpected weekday %v", each.Date.Weekday())
+			}
+		}
+	}
+
+	if rs, _ := collection.Filter("[w!=wed]"); len(rs) != 32 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	ro := &Locale{Weekdays: []string{"duminică", "luni", "marți", "miercuri", "joi", "vineri", "sâmbătă"}}
+	if rs, _ := collection.FilterWithLocale("[w=vineri]", ro); len(rs) != 8 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if rs, _ := collection.FilterWithLocale("[w=duminică]", ro); len(rs) != 1 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if _, err := collection.Filter("[w=someday]"); err == nil {
+		t.Error("expected unknown weekday to fail but didn't")
+	}
+}
+
+func TestPage(t *testing.T) {
+	rs, _ := collection.Filter("[a=alex]")
+
+	if page := rs.Page(10, 5); len(page) != 5 {
+		t.Errorf("unexpected page size %d\n", len(page))
+	} else {
+		for i, each := range page {
+			if each.String() != rs[10+i].String() {
+				t.Errorf("unexpected record %v on page", each)
+			}
+		}
+	}
+
+	if page := rs.Page(30, 5); len(page) != 2 {
+		t.Errorf("unexpected page size %d\n", len(page))
+	}
+
+	if page := rs.Page(32, 5); len(page) != 0 {
+		t.Errorf("unexpected page size %d\n", len(page))
+	}
+
+	if page := rs.Page(-5, 3); len(page) != 3 || page[0].String() != rs[0].String() {
+		t.Errorf("unexpected page %v\n", page)
+	}
+
+	if page := rs.Page(0, -1); len(page) != 0 {
+		t.Errorf("unexpected page size %d\n", len(page))
+	}
+}
+
+func TestSortBy(t *testing.T) {
+	rs := collection.SortBy("date", false)
+	if len(rs) != len(collection) {
+		t.Fatalf("unexpected nr of results %d\n", len(rs))
+	}
+
+	for i := 1; i < len(rs); i++ {
+		if rs[i].Date.Before(rs[i-1].Date) {
+			t.Errorf("expected ascending dates but got %v before %v", rs[i-1].Date, rs[i].Date)
+		}
+	}
+
+	if rs[0].Label != "Apa" || rs[len(rs)-1].Amount != -9861 {
+		t.Error("expected stable order for same dates")
+	}
+
+	rs = collection.SortBy("amount", true)
+	for i := 1; i < len(rs); i++ {
+		if rs[i].Amount > rs[i-1].Amount {
+			t.Errorf("expected descending amounts but got %v before %v", rs[i-1].Amount, rs[i].Amount)
+		}
+	}
+
+	if rs[0].Amount != 99999_99 || rs[len(rs)-1].Amount != -55920_00 {
+		t.Errorf("unexpected first or last amounts %v, %v", rs[0].Amount, rs[len(rs)-1].Amount)
+	}
+
+	if rs := collection.SortBy("sender", false); rs[0].Sender != "Alexandru" || rs[len(rs)-1].Sender != "Ordonator" {
+		t.Error("unexpected order of senders")
+	}
+}
+
+func TestSignedAmountConditions(t *testing.T) {
+	pairs := map[string]string{
+		"(v<-1000)":   "(s>1000; z<0)",
+		"[v<-1000]":   "[s>1000; z<0]",
+		"(v>1000)":    "(s>1000; z>0)",
+		"[v>1000]":    "[s>1000; z>0]",
+		"[v>0]":       "[z>0]",
+		"[v=-1000]":   "[s=1000; z<0]",
+		"[v=1000]":    "[s=1000; z>0]",
+		"(v=-40,22)":  "(s=40,22)",
+		"[v!=-1000]":  "[] - [s=1000; z<0]",
+		"(v>-1000)":   "(s<1000; z<0) + [z>0]",
+		"(v>-20;v<0)": "(s<20; z<0)",
+	}
+
+	for signed, unsigned := range pairs {
+		expected, _ := collection.Filter(unsigned)
+		if rs, err := collection.Filter(signed); err != nil {
+			t.Error(err)
+		} else if len(rs) != len(expected) || len(rs) == 0 {
+			t.Errorf("unexpected nr of results for %v: %d, expected %d\n", signed, len(rs), len(expected))
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	queries := []string{
+		"",
+		"[a=alex]",
+		"[a=catrina] + [b=catrina]",
+		"[] - [a=alex]",
+		"[a=alex] & [c=alimente]",
+		"(s>1000; z<0)",
+		"[b=magazin; d=octombrie 2019] + [b=magazin; d=ianuarie 2020]",
+	}
+
+	for _, q := range queries {
+		rs, _ := collection.Filter(q)
+		if n, err := collection.Count(q); err != nil {
+			t.Error(err)
+		} else if n != len(rs) {
+			t.Errorf("unexpected count for %v: %d, expected %d\n", q, n, len(rs))
+		}
+	}
+
+	if _, err := collection.Count("[a>alex]"); err == nil {
+		t.Error("expected count to fail but didn't")
+	}
+}
+
+func TestInternationalAmounts(t *testing.T) {
+	amounts := map[string]int64{
+		"-27.73":       -27_73,
+		"-4022":        -40_22,
+		"1,000.50":     1_000_50,
+		"1 000,50":     1_000_50,
+		"$1.000,50":    1_000_50,
+		"-$1.000,50":   -1_000_50,
+		"$-1,000.50":   -1_000_50,
+		"1'000.50 CHF": 1_000_50,
+		"€ 12,5":       12_50,
+		"12.50 RON":    12_50,
+		"1.000.000":    1_000_000_00,
+		"-1,234,567.8": -1_234_567_80,
+		"1,000":        1_000_00,
+		"$1,000":       1_000_00,
+		"1 000":        1_000_00,
+		"1,000.00":     1_000_00,
+		"12,345,678":   12_345_678_00,
+		"0,50":         50,
+		"EUR12.50":     12_50,
+	}
+
+	for text, expected := range amounts {
+		if val, err := toCents(text); err != nil {
+			t.Error(err)
+		} else if val != expected {
+			t.Errorf("unexpected amount for %v: %v", text, val)
+		}
+	}
+
+	for _, text := range []string{"-27x73", "1.2345", "--10", "RON", "1,2.3,4", "0.125", "abc12", "12 lei", "RON EUR 12"} {
+		if val, err := toCents(text); err == nil {
+			t.Errorf("expected %v to fail but got %v", text, val)
+		}
+	}
+
+	OPT_GROUPING = " "
+	defer func() { OPT_GROUPING = "" }()
+
+	if val, err := toCents("1 000.500"); err == nil {
+		t.Errorf("expected to fail with explicit grouping but got %v", val)
+	}
+
+	if all, err := NewSafe(strings.NewReader(`a,b,c,2019-12-05,"-1 000,50 RON"`)); err != nil {
+		t.Error(err)
+	} else if all[0].Amount != -1_000_50 {
+		t.Errorf("unexpected amount %v", all[0].Amount)
+	}
+}
+
+func TestRecordLines(t *testing.T) {
+	all := New(strings.NewReader(sample))
+
+	expected := map[int]int{0: 2, 1: 3, 22: 24, 23: 25, 24: 25, 25: 26, 41: 38}
+	for i, line := range expected {
+		if all[i].Line != line {
+			t.Errorf("unexpected line for %v: %v", all[i], all[i].Line)
+		}
+	}
+
+	if all[23].Label != "Casă și curățenie" || all[24].Label != "Alimente" {
+		t.Error("unexpected split records")
+	}
+}
+
+func TestSplitRecordsParent(t *testing.T) {
+	for i, each := range New(strings.NewReader(sample)) {
+		if i == 23 || i == 24 {
+			if each.ParentAmount != -27_73 || each.RawLabel != "11.58 Casă și curățenie + 16.15 Alimente" {
+				t.Errorf("unexpected parent of split record %v", each)
+			}
+		} else if i == 26 || i == 27 {
+			if each.ParentAmount != -198_29 || each.RawLabel != "139.94 Alimente + 58.35 Apă" {
+				t.Errorf("unexpected parent of split record %v", each)
+			}
+		} else if i == 0 && (each.ParentAmount != 0 || each.RawLabel != "") {
+			t.Errorf("unexpected parent of record %v", each)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if errs := Validate(strings.NewReader(sample)); len(errs) != 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+
+	input := `a,b,c,2019-12-05,100
+a,b,11.58 x + 16.15 y,2019-12-05,-27.00
+a,b,c,2019-12-05,100
+a,b,c,2019'12'05,100
+a,b,c,2019-12-05,1x0`
+
+	errs := Validate(strings.NewReader(input))
+	if len(errs) != 3 {
+		t.Fatalf("unexpected nr of errors %v", errs)
+	}
+
+	for i, prefix := range []string{"row 2, doesn't add up", "row 4, column 3", "row 5, column 4"} {
+		if !strings.HasPrefix(errs[i].Error(), prefix) {
+			t.Errorf("unexpected error %v", errs[i])
+		}
+	}
+
+	if errs := Validate(strings.NewReader("a,b,c,2019-12-05,100\na,\"b,c")); len(errs) != 1 {
+		t.Errorf("unexpected nr of errors %v", errs)
+	}
+}
+
+func TestCustomLabelSeparator(t *testing.T) {
+	input := `a,b,11.58 Casă și curățenie & 16.15 Alimente,2019-12-05,-27.73
+a,b,Plată A+B,2019-12-06,-10.00`
+
+	opts := DefaultOptions()
+	opts.Separator = "&"
+
+	if all, err := NewWithOptions(strings.NewReader(input), opts); err != nil {
+		t.Error(err)
+	} else if len(all) != 3 {
+		t.Errorf("unexpected nr of records %v", len(all))
+	} else if all[0].Label != "Casă și curățenie" || all[0].Amount != -11_58 || all[1].Label != "Alimente" || all[2].Label != "Plată A+B" {
+		t.Errorf("unexpected records %v", all)
+	}
+
+	opts.Separator = ""
+	if all, err := NewWithOptions(strings.NewReader(sample), opts); err != nil {
+		t.Error(err)
+	} else if len(all) != 37 {
+		t.Errorf("unexpected nr of records %v", len(all))
+	}
+
+	if _, err := NewSafe(strings.NewReader(input)); err == nil {
+		t.Error("expected default separator to fail but didn't")
+	}
+}
+
+func TestSplitRecordWithoutLabel(t *testing.T) {
+	if all, err := NewSafe(strings.NewReader(`a,b,11.58 Casă + 16.15,2019-12-05,-27.73`)); err != nil {
+		t.Error(err)
+	} else if len(all) != 2 {
+		t.Errorf("unexpected nr of records %v", len(all))
+	} else if all[0].Label != "Casă" || all[1].Label != "" || all[1].Amount != -16_15 {
+		t.Errorf("unexpected records %v", all)
+	}
+}
+
+func TestRunningBalance(t *testing.T) {
+	balances := collection.RunningBalance()
+	if len(balances) != len(collection) {
+		t.Fatalf("unexpected nr of balances %v", len(balances))
+	}
+
+	if balances[0] != -30_43 || balances[1] != -379_43 {
+		t.Errorf("unexpected first balances %v", balances[:2])
+	}
+
+	if last := balances[len(balances)-1]; last != collection.Sum() {
+		t.Errorf("expected final balance to match sum but got %v", last)
+	}
+
+	if balances := (Collection{}).RunningBalance(); len(balances) != 0 {
+		t.Errorf("unexpected balances %v", balances)
+	}
+}
+
+func TestMinMaxAverage(t *testing.T) {
+	if min := collection.Min(); min != -55920_00 {
+		t.Errorf("unexpected min %v", min)
+	}
+
+	if max := collection.Max(); max != 99999_99 {
+		t.Errorf("unexpected max %v", max)
+	}
+
+	if avg := collection.Average(); fmt.Sprintf("%.2f", avg) != "111641.48" {
+		t.Errorf("unexpected average %v", avg)
+	}
+
+	if rs, _ := collection.Filter("[b=dentist]"); rs.Min() != -850_00 || rs.Max() != -200_00 || rs.Average() != -550_00 {
+		t.Errorf("unexpected stats %v, %v, %v", rs.Min(), rs.Max(), rs.Average())
+	}
+
+	if empty := (Collection{}); empty.Min() != 0 || empty.Max() != 0 || empty.Average() != 0 {
+		t.Error("expected zero stats for empty collection")
+	}
+}
+
+func TestCaseSensitiveMatch(t *testing.T) {
+	records := Collection{
+		{Sender: "ACME", Receiver: "b", Label: "c", Amount: 100},
+		{Sender: "acme", Receiver: "b", Label: "c", Amount: 200},
+	}
+
+	if rs, _ := records.Filter(`[a="acme"]`); len(rs) != 2 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if rs, _ := records.Filter(`[a='ACME']`); len(rs) != 1 || rs[0].Sender != "ACME" {
+		t.Errorf("unexpected results %v\n", rs)
+	}
+
+	if rs, _ := records.Filter(`[a='Acme']`); len(rs) != 0 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if rs, _ := collection.Filter(`[a='Ordonator']`); len(rs) != 4 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if rs, _ := collection.Filter(`[a='ordonator']`); len(rs) != 0 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+}
+
+func TestGroupedFormulas(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	flat, _ := records.Filter(`[a=alex] + [b=alex] - [c=?]`)
+	if rs, err := records.Filter(`([a=alex] + [b=alex]) - [c=?]`); err != nil || len(rs) != 28 || fmt.Sprint(rs) != fmt.Sprint(flat) {
+		t.Errorf("expected same results as flat query but got %d, %v", len(rs), err)
+	}
+
+	if rs, err := records.Filter(`[a=alex] + ([b=alex] - [c=?])`); err != nil || len(rs) != 35 {
+		t.Errorf("unexpected nr of results %d, %v", len(rs), err)
+	}
+
+	if rs, err := records.Filter(`(([a=catrina] + [b=catrina]) & ([c=alimente] + [c=?])) - [s<60]`); err != nil || len(rs) != 3 {
+		t.Errorf("unexpected nr of results %d, %v", len(rs), err)
+	} else {
+		for _, r := range rs {
+			if r.Sender != "Catrina" && r.Receiver != "Catrina" || !strings.EqualFold(r.Label, "alimente") && r.Label != "?" || r.Amount > -60_00 && r.Amount < 60_00 {
+				t.Errorf("unexpected record %v", r)
+			}
+		}
+	}
+
+	if rs, err := records.Filter(`[a=catrina] + [b=catrina] & [c=alimente] + [c=?] - [s<60]`); err != nil || len(rs) != 8 {
+		t.Errorf("unexpected nr of results %d, %v", len(rs), err)
+	}
+
+	if _, err := records.Filter(`(([a=alex]) + [b=alex]`); !errors.Is(err, ErrUnbalancedParens) {
+		t.Errorf("expected fail but got %v", err)
+	}
+}
+
+func TestRangeFormulas(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	pairs := [][2]string{
+		{`[s = 1000..2000]`, `[s > 1000; s < 2000]`},
+		{`(s = 1000..2000]`, `(s > 1000; s < 2000]`},
+		{`[s = 100..500)`, `[s > 100; s < 500)`},
+		{`[v = -500..-100]`, `[v > -500; v < -100]`},
+		{`[d = 2020-01-11..2020-01-15]`, `[d > 2020-01-11; d < 2020-01-15]`},
+		{`(d = 2020-01-11..2020-01-15)`, `(d > 2020-01-11; d < 2020-01-15)`},
+		{`[s != 100..500]`, `[s < 100] + [s > 500]`},
+	}
+
+	for _, pair := range pairs {
+		rs1, err1 := records.Filter(pair[0])
+		rs2, err2 := records.Filter(pair[1])
+		if err1 != nil || err2 != nil || fmt.Sprint(rs1) != fmt.Sprint(rs2) {
+			t.Errorf("expected %s to match %s but got %d and %d", pair[0], pair[1], len(rs1), len(rs2))
+		}
+	}
+
+	rs1, _ := records.Filter(`[s = 1000..2000]`)
+	rs2, _ := records.Filter(`(s = 1000..2000]`)
+	if len(rs1) != 4 || len(rs2) != 1 {
+		t.Errorf("expected inclusive range to include 1000.00 but got %d and %d", len(rs1), len(rs2))
+	}
+
+	if _, err := records.Filter(`[s > 100..500]`); !errors.Is(err, ErrUnsupportedOperator) {
+		t.Errorf("expected fail but got %v", err)
+	}
+}
+
+func TestAmountScale(t *testing.T) {
+	defer func() { OPT_AMOUNT_SCALE = 2 }()
+
+	OPT_AMOUNT_SCALE = 0 // JPY
+	all, err := NewSafe(strings.NewReader("a,b,c,2019-12-05,-1500\na,b,c,2019-12-06,\"1,000\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	} else if all[0].Amount != -1500 || all[1].Amount != 1000 {
+		t.Errorf("unexpected amounts %v, %v", all[0].Amount, all[1].Amount)
+	}
+
+	if _, err := toCents("12.50"); err == nil {
+		t.Error("expected decimals to fail without scale")
+	}
+
+	if rs, _ := all.Filter("[s=1500]"); len(rs) != 1 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if out := formatAmount(-1500); out != "-1500" {
+		t.Errorf("unexpected format %v", out)
+	}
+
+	OPT_AMOUNT_SCALE = 3 // BHD
+	all, err = NewSafe(strings.NewReader("a,b,c,2019-12-05,-1.500\na,b,c,2019-12-06,\"1,000.250\"\na,b,c,2019-12-07,2.5\n"))
+	if err != nil {
+		t.Fatal(err)
+	} else if all[0].Amount != -1_500 || all[1].Amount != 1_000_250 || all[2].Amount != 2_500 {
+		t.Errorf("unexpected amounts %v, %v, %v", all[0].Amount, all[1].Amount, all[2].Amount)
+	}
+
+	if rs, _ := all.Filter("[s=1000]"); len(rs) != 1 || rs[0].Amount != 1_000_250 {
+		t.Errorf("unexpected results %v\n", rs)
+	}
+
+	if out := formatAmount(-1_000_250); out != "-1000.250" {
+		t.Errorf("unexpected format %v", out)
+	}
+}
+
+func TestDecimalComma(t *testing.T) {
+	all, err := NewSafe(strings.NewReader("a,b,c,2019-12-05,\"-27,73\"\na,b,c,2019-12-06,\"1.027,73\"\na,b,c,2019-12-07,\"40,2\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	} else if all[0].Amount != -27_73 || all[1].Amount != 1_027_73 || all[2].Amount != 40_20 {
+		t.Errorf("unexpected amounts %v, %v, %v", all[0].Amount, all[1].Amount, all[2].Amount)
+	}
+
+	if rs, _ := all.Filter("[s=27,73]"); len(rs) != 1 || rs[0].Amount != -27_73 {
+		t.Errorf("unexpected results %v\n", rs)
+	}
+
+	if rs, _ := all.Filter("[s=40,2]"); len(rs) != 1 || rs[0].Amount != 40_20 {
+		t.Errorf("unexpected results %v\n", rs)
+	}
+
+	OPT_DECIMAL = "."
+	defer func() { OPT_DECIMAL = "" }()
+
+	if val, err := toCents("1.500"); err == nil {
+		t.Errorf("expected to fail with explicit decimal separator but got %v", val)
+	} else if val, err := toCents("1,500.5"); err != nil || val != 1_500_50 {
+		t.Errorf("unexpected amount %v, %v", val, err)
+	}
+
+	if rs, _ := all.Filter("[s=27.73]"); len(rs) != 1 || rs[0].Amount != -27_73 {
+		t.Errorf("unexpected results %v\n", rs)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	matched, rest, err := records.Partition("[v<0]")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(matched)+len(rest) != len(records) {
+		t.Errorf("unexpected partitions %d and %d", len(matched), len(rest))
+	}
+
+	if count, _ := records.Count("[v<0]"); len(matched) != count {
+		t.Errorf("unexpected nr of matched records %d", len(matched))
+	}
+
+	seen := make(map[string]bool)
+	for _, r := range matched {
+		seen[r.String()] = true
+		if r.Amount >= 0 {
+			t.Errorf("unexpected matched record %v", r)
+		}
+	}
+
+	for _, r := range rest {
+		if seen[r.String()] || r.Amount < 0 {
+			t.Errorf("unexpected record in rest %v", r)
+		}
+	}
+
+	// both partitions keep the original order
+	i, j := 0, 0
+	for _, r := range records {
+		if i < len(matched) && matched[i].String() == r.String() {
+			i++
+		} else if j < len(rest) && rest[j].String() == r.String() {
+			j++
+		} else {
+			t.Fatalf("record %v is out of order", r)
+		}
+	}
+
+	if _, _, err := records.Partition("[a>alex]"); err == nil {
+		t.Error("expected partition to fail but didn't")
+	}
+}
+
+func TestUnknownLabels(t *testing.T) {
+	records := Collection{
+		{Sender: "a", Receiver: "b", Label: "?", Amount: 100},
+		{Sender: "a", Receiver: "b", Label: "", Amount: 200},
+		{Sender: "a", Receiver: "b", Label: " ? ", Amount: 300},
+		{Sender: "a", Receiver: "b", Label: "?abc", Amount: 400},
+		{Sender: "a", Receiver: "b", Label: "abc", Amount: 500},
+	}
+
+	for _, q := range []string{"[c=?]", "[c=<empty>]", "[c=<EMPTY>]"} {
+		if rs, _ := records.Filter(q); len(rs) != 3 {
+			t.Errorf("unexpected nr of results for %s: %d\n", q, len(rs))
+		} else {
+			for _, r := range rs {
+				if r.Amount > 300 {
+					t.Errorf("unexpected record for %s: %v", q, r)
+				}
+			}
+		}
+	}
+
+	if rs, _ := records.Filter("[c!=?]"); len(rs) != 2 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if rs, _ := collection.Filter("[c=?]"); len(rs) != 11 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	var buf bytes.Buffer
+	if err := records.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	} else if len(decoded) != len(records) {
+		t.Fatalf("doesn't match nr of records %v\n", len(decoded))
+	}
+
+	for i, each := range records {
+		if decoded[i]["sender"] != each.Sender || decoded[i]["label"] != each.Label || decoded[i]["amount"] != float64(each.Amount) {
+			t.Errorf("record %v doesn't match %v", decoded[i], each)
+		}
+	}
+
+	buf.Reset()
+	if err := records.WriteNDJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := json.NewDecoder(&buf)
+	for i := 0; ; i++ {
+		var each map[string]interface{}
+		if err := decoder.Decode(&each); err == io.EOF {
+			if i != len(records) {
+				t.Errorf("doesn't match nr of records %v\n", i)
+			}
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		} else if each["receiver"] != records[i].Receiver || each["date"] != records[i].Date.Format(time.RFC3339) {
+			t.Errorf("record %v doesn't match %v", each, records[i])
+		}
+	}
+
+	buf.Reset()
+	if err := (Collection{}).WriteJSON(&buf); err != nil || strings.TrimSpace(buf.String()) != "[\n]" {
+		t.Errorf("unexpected empty json %q, %v", buf.String(), err)
+	}
+}
+
+func TestNewFromFile(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"comma.csv":     "a,b,c,2019-12-05,\"-27,73\"\na,b,\"c; d\",2019-12-06,1000\n",
+		"semicolon.csv": "a;b;c;2019-12-05;-27,73\na;b;c, d;2019-12-06;1000\n",
+		"tab.csv":       "a\tb\tc\t2019-12-05\t-27,73\na\tb\tc; d\t2019-12-06\t1000\n",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if all, err := NewFromFile(path); err != nil {
+			t.Errorf("unexpected error for %s: %v", name, err)
+		} else if len(all) != 2 || all[0].Amount != -27_73 || all[1].Amount != 1000 || all[1].Receiver != "b" {
+			t.Errorf("unexpected records for %s: %v", name, all)
+		}
+	}
+
+	if _, err := NewFromFile(filepath.Join(dir, "missing.csv")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected fail but got %v", err)
+	}
+
+	if d := sniffDelimiter([]byte(sample)); d != ',' {
+		t.Errorf("unexpected delimiter %q", d)
+	}
+}
+
+func TestDiacritics(t *testing.T) {
+	records := Collection{
+		{Sender: "Casă de Marcat", Receiver: "Brașov", Label: "Împrumut", Amount: 100},
+		{Sender: "Crème Brûlée", Receiver: "Café de Flore", Label: "Déjeuner", Amount: 200},
+		{Sender: "Mädchen", Receiver: "Øresund", Label: "?", Amount: 300},
+	}
+
+	plain := &Locale{}
+	queries := map[string]int{
+		`[a=casa]`:            100,
+		`[b=brasov]`:          100,
+		`[c=imprumut]`:        100,
+		`[c=ÎMPRUMUT]`:        100,
+		`[a=creme brulee]`:    200,
+		`[b="café de flore"]`: 200,
+		`[b=*de flore*]`:      200,
+		`[c=dejeuner]`:        200,
+		`[a=madchen]`:         300,
+	}
+
+	for q, amount := range queries {
+		if rs, err := records.FilterWithLocale(q, plain); err != nil || len(rs) != 1 || rs[0].Amount != int64(amount) {
+			t.Errorf("unexpected results for %s: %v, %v", q, rs, err)
+		}
+	}
+
+	custom := &Locale{Unicode: map[string]string{"ä": "ae", "ø": "o"}}
+	if rs, _ := records.FilterWithLocale(`[a=maedchen]`, custom); len(rs) != 1 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if rs, _ := records.FilterWithLocale(`[a=madchen]`, custom); len(rs) != 0 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if rs, _ := records.FilterWithLocale(`[b=oresund]`, custom); len(rs) != 1 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+}
+
+func TestRecordKey(t *testing.T) {
+	all, err := NewSafe(strings.NewReader("a,b,10 cafea + 10 cafea + 5 apa,2019-12-05,-25\na,b,alimente,2019-12-05,-30\n"))
+	if err != nil {
+		t.Fatal(err)
+	} else if all[0].String() != all[1].String() || all[0].Part != 1 || all[1].Part != 2 || all[3].Part != 0 {
+		t.Fatalf("unexpected split records %v", all)
+	}
+
+	if rs, _ := all.Filter("[c=alimente] + [c=cafea]"); len(rs) != 3 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if matched, rest, _ := all.Partition("[c=cafea]"); len(matched) != 2 || len(rest) != 2 {
+		t.Errorf("unexpected partitions %v and %v", matched, rest)
+	}
+
+	defer func(key func(Record) string) { OPT_RECORD_KEY = key }(OPT_RECORD_KEY)
+	OPT_RECORD_KEY = Record.String
+
+	if rs, _ := all.Filter("[c=alimente] + [c=cafea]"); len(rs) != 2 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+}
+
+// cancelAfter is a context cancelled after it was checked a number of times
+type cancelAfter struct {
+	context.Context
+	checks int
+}
+
+func (ctx *cancelAfter) Err() error {
+	if ctx.checks--; ctx.checks < 0 {
+		return context.Canceled
+	}
+
+	return nil
+}
+
+func TestFilterContext(t *testing.T) {
+	records := New(strings.NewReader(strings.Repeat(sample, 100)))
+
+	if rs, err := records.FilterContext(context.Background(), "[a=alex]"); err != nil || len(rs) != 3200 {
+		t.Errorf("unexpected nr of results %d, %v", len(rs), err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := records.FilterContext(ctx, "[a=alex]"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancelled filter but got %v", err)
+	}
+
+	ctx2 := &cancelAfter{context.Background(), 2}
+	if _, err := records.FilterContext(ctx2, "[a=alex] + [b=alex]"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancelled filter but got %v", err)
+	} else if ctx2.checks != -1 {
+		t.Errorf("expected to stop on first cancelled check, got %d", ctx2.checks)
+	}
+}
+
+// queryRecursive is the previous implementation of query, one call per filter
+func queryRecursive(records Collection, filters []comparator) (Collection, error) {
+	if len(records) == 0 || len(filters) == 0 {
+		return records, nil
+	}
+
+	var newRecords = make([]Record, 0)
+	for _, record := range records {
+		if ok, err := filters[0].Compare(record); err != nil {
+			return nil, err
+		} else if ok {
+			newRecords = append(newRecords, record)
+		}
+	}
+
+	return queryRecursive(newRecords, filters[1:])
+}
+
+var manyConditions = "s>1; s<100000; d>2019-01-01; d<2021-12-31; a!=zzz; b!=zzz; c!=zzz; x!=zzz; v>-100000; v<100000; " +
+	"s>2; s<99999; d>2019-01-02; d<2021-12-30; a!=yyy; b!=yyy; c!=yyy; x!=yyy; v>-99999; v<99999"
+
+func TestIterativeQuery(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	for _, q := range []string{"a=alex", "a=alex; c=?", "s>100; s<500; b!=catrina", "x=catrina; d>2019-12-01", manyConditions, "a=nobody; s>1", ""} {
+		filters, err := prepare(&scope{true, true}, CurrentLocale(), []byte(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected, _ := queryRecursive(records, filters)
+		if rs, err := query(context.Background(), records, filters); err != nil || fmt.Sprint(rs) != fmt.Sprint(expected) {
+			t.Errorf("unexpected results for %s: %d instead of %d, %v", q, len(rs), len(expected), err)
+		}
+	}
+
+	filters, _ := prepare(&scope{true, true}, CurrentLocale(), []byte("a=alex; s=1"))
+	filters[1].operator = '?'
+	if _, err := query(context.Background(), records, filters); !errors.Is(err, ErrUnsupportedOperator) {
+		t.Errorf("expected fail but got %v", err)
+	}
+}
+
+func BenchmarkQueryManyConditions(b *testing.B) {
+	records := New(strings.NewReader(strings.Repeat(sample, 100)))
+	filters, _ := prepare(&scope{true, true}, CurrentLocale(), []byte(manyConditions))
+
+	b.Run("iterative", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			query(context.Background(), records, filters)
+		}
+	})
+
+	b.Run("recursive", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			queryRecursive(records, filters)
+		}
+	})
+}
+
+var nonAlphaNumeric = regexp.MustCompile(`[^a-z0-9]`)
+
+// doesItMatch is the previous implementation of text matching, it normalizes
+// both the keyword and the value for every record
+func doesItMatch(lc *Locale, keyword string, value string) bool {
+	if keyword == _UNKNOWN_VALUE || strings.EqualFold(keyword, _EMPTY_VALUE) {
+		return isUnknown(value)
+	}
+
+	lastIndex := len(keyword) - 1
+	if lastIndex > 0 && keyword[0] == '\'' && keyword[lastIndex] == '\'' {
+		return value == keyword[1:lastIndex] // case sensitive
+	}
+
+	asciiKeyword := stripMarks(lc.Translate(strings.ToLower(keyword)))
+	asciiLookupValue := stripMarks(lc.Translate(strings.ToLower(value)))
+
+	if last := len(asciiKeyword) - 1; last > 0 && asciiKeyword[0] == '"' && asciiKeyword[last] == '"' {
+		return asciiLookupValue == asciiKeyword[1:last]
+	}
+
+	if last := len(asciiKeyword) - 1; last > 1 && asciiKeyword[0] == '*' && asciiKeyword[last] == '*' {
+		needle := asciiKeyword[1:last] // contains instead of prefix
+		return strings.Contains(asciiLookupValue, needle) || strings.Contains(nonAlphaNumeric.ReplaceAllString(asciiLookupValue, " "), needle)
+	}
+
+	if strings.HasPrefix(asciiLookupValue, asciiKeyword) {
+		return true
+	}
+
+	az09 := strings.TrimSpace(nonAlphaNumeric.ReplaceAllString(asciiLookupValue, " "))
+
+	return strings.HasPrefix(az09, asciiKeyword)
+}
+
+var textKeywords = []string{"alex", "ALEX", "*market*", "*#1*", "#1", "beneficiar 1", `"apa"`, `'Apa'`, "?", "<empty>", "magazin", "împrumut", "imprumut", "x"}
+
+func TestPreparedKeywords(t *testing.T) {
+	records := New(strings.NewReader(sample))
+	lc := &Locale{Unicode: map[string]string{"î": "i", "ă": "a"}}
+
+	for _, text := range textKeywords {
+		k := newKeyword(lc, text)
+		for _, r := range records {
+			for _, value := range []string{r.Sender, r.Receiver, r.Label} {
+				ascii := normalize(lc, value)
+				if k.matches(value, ascii, alphaNumeric(ascii)) != doesItMatch(lc, text, value) {
+					t.Errorf("keyword %s doesn't match %s the same way", text, value)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkTextMatching(b *testing.B) {
+	records := New(strings.NewReader(strings.Repeat(sample, 100)))
+	lc := &Locale{Unicode: map[string]string{"î": "i", "ă": "a"}}
+	filters, _ := prepare(&scope{true, true}, lc, []byte("x=zzz,*market*,beneficiar 1"))
+
+	b.Run("prepared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			query(context.Background(), records, filters)
+		}
+	})
+
+	b.Run("per record", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, r := range records {
+				for _, value := range []string{r.Sender, r.Receiver} {
+					for _, text := range []string{"zzz", "*market*", "beneficiar 1"} {
+						if doesItMatch(lc, text, value) {
+							break
+						}
+					}
+				}
+			}
+		}
+	})
+}
+
+func TestIndexedCollection(t *testing.T) {
+	records := New(strings.NewReader(sample))
+	ix := records.Index()
+
+	queries := []string{
+		"[]", "[d>2019-12-01]", "(d>2019-12-01)", "[d<2019-12-01]", "(d<2019-12-01)", "[d=2019-12-05]", "[d=2019-11-01..2019-12-31)",
+		"[s>1000]", "(s>1000)", "[s<60]", "(s<60)", "[s=1000]", "[s=40,22]", "(s=100..500]", "[v<-100]", "(v>-100)", "[v=-40]", "[v=100..1000]",
+		`[a="alexandru"]`, `[b='Catrina']`, `[x="catrina"]`, `[c="?", "apa"]`, `[c=?]`, "[a=alex; s>100]", "[a=alex; s>100 | d<2019-11-01]",
+		"(d>2019-12-01; s<100] + [a=catrina] - [s=1000] & [v<0]", "[s!=1000; d!=2019-12-05]",
+	}
+
+	for _, q := range queries {
+		expected, err1 := records.Filter(q)
+		rs, err2 := ix.Filter(q)
+		if err1 != nil || err2 != nil || fmt.Sprint(rs) != fmt.Sprint(expected) {
+			t.Errorf("unexpected results for %s: %d instead of %d, %v, %v", q, len(rs), len(expected), err1, err2)
+		}
+	}
+
+	if _, err := ix.Filter("[a>alex]"); !errors.Is(err, ErrUnsupportedOperator) {
+		t.Errorf("expected fail but got %v", err)
+	}
+}
+
+func BenchmarkIndexedRange(b *testing.B) {
+	records := New(strings.NewReader(strings.Repeat(sample, 100)))
+	ix := records.Index()
+	q := "[d=2019-12-01..2019-12-05; s>1000]"
+
+	b.Run("indexed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ix.Filter(q)
+		}
+	})
+
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			records.Filter(q)
+		}
+	})
+}
+
+func TestMultipleValues(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	pairs := [][2]string{
+		{`[s=1000,9000]`, `[s=1000] + [s=9000]`},
+		{`[s=40,22, 9000]`, `[s=40,22] + [s=9000]`},
+		{`[v=-40,-1000]`, `[v=-40] + [v=-1000]`},
+		{`[d=2019-10-15,2019-11-19]`, `[d=2019-10-15] + [d=2019-11-19]`},
+		{`[d=2019-10-15, 2019-12-01..2019-12-05]`, `[d=2019-10-15] + [d=2019-12-01..2019-12-05]`},
+		{`[s!=1000,9000]`, `[] - [s=1000] - [s=9000]`},
+	}
+
+	for _, pair := range pairs {
+		rs1, err1 := records.Filter(pair[0])
+		rs2, err2 := records.Filter(pair[1])
+		if err1 != nil || err2 != nil || len(rs1) == 0 || fmt.Sprint(rs1) != fmt.Sprint(rs2) {
+			t.Errorf("expected %s to match %s but got %d and %d, %v, %v", pair[0], pair[1], len(rs1), len(rs2), err1, err2)
+		}
+	}
+
+	if rs, _ := records.Filter(`[s=1000,9000]`); len(rs) != 4 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if rs, _ := records.Index().Filter(`[s=1000,9000; d=2019-10-15,2019-11-19]`); len(rs) != 2 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	if _, err := records.Filter(`[s>1000,9000]`); !errors.Is(err, ErrUnsupportedOperator) {
+		t.Errorf("expected fail but got %v", err)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	first := New(strings.NewReader("a,b,c,2019-12-05,-100\na,b,5 d + 5 e,2019-12-06,-10\n"))
+	second := New(strings.NewReader("x,y,z,2019-12-07,300\na,b,5 d + 5 e,2019-12-06,-10\na,b,c,2019-12-05,-100\na,b,c,2019-12-05,-200\n"))
+
+	if !first[0].Equal(second[3]) || first[0].Line == second[3].Line {
+		t.Errorf("expected %v to equal %v", first[0], second[3])
+	} else if first[0].Equal(second[4]) || first[1].Equal(first[2]) {
+		t.Error("expected records to differ")
+	}
+
+	utc, _ := time.Parse(time.RFC3339, "2019-12-05T02:00:00+02:00")
+	if moved := (Record{Date: utc}); !moved.Equal(Record{Date: utc.UTC()}) {
+		t.Error("expected same moment to be equal")
+	}
+
+	all := append(append(Collection{}, first...), second...).Dedup()
+	expected := []string{"c", "d", "e", "z", "c"}
+	if len(all) != len(expected) {
+		t.Fatalf("unexpected nr of records %v", all)
+	}
+
+	for i, r := range all {
+		if r.Label != expected[i] {
+			t.Errorf("unexpected record %v at %d", r, i)
+		}
+	}
+
+	if all[4].Amount != -200 {
+		t.Errorf("unexpected last record %v", all[4])
+	}
+
+	split := Record{Sender: "a", Label: "c", Split: true}
+	if split.Equal(Record{Sender: "a", Label: "c"}) {
+		t.Error("expected split records to differ")
+	} else if rs := (Collection{split, {Sender: "a", Label: "c"}, split}).Dedup(); len(rs) != 2 || !rs[0].Split || rs[1].Split {
+		t.Errorf("unexpected records %v", rs)
+	}
+}
+
+func TestQueryBuilder(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	q := Query().Sender("alex").AmountGreaterThan(1000_00).Or().Receiver("catrina").String()
+	if q != "(a=alex; s>1000,00 | b=catrina)" {
+		t.Errorf("unexpected query %s", q)
+	}
+
+	expected, _ := records.Filter("(a=alex; s>1000) + (b=catrina)")
+	if rs, err := records.Filter(q); err != nil || len(rs) == 0 || fmt.Sprint(rs) != fmt.Sprint(expected) {
+		t.Errorf("unexpected results %d, %v", len(rs), err)
+	}
+
+	day := time.Date(2019, time.December, 5, 0, 0, 0, 0, time.UTC)
+	q = Query().DateAfter(day.AddDate(0, 0, -1)).DateBefore(day.AddDate(0, 0, 1)).AmountLessThan(100_00).String()
+	if rs, err := records.Filter(q); err != nil || len(rs) == 0 {
+		t.Errorf("unexpected results %d, %v", len(rs), err)
+	} else {
+		for _, r := range rs {
+			if !r.Date.Equal(day) || r.Amount <= -100_00 || r.Amount >= 100_00 {
+				t.Errorf("unexpected record %v", r)
+			}
+		}
+	}
+
+	if q := Query().String(); q != "()" {
+		t.Errorf("unexpected empty query %s", q)
+	}
+
+	if q := Query().AmountEquals(-12_50).String(); q != "(s=-12,50)" {
+		t.Errorf("unexpected query %s", q)
+	}
+
+	OPT_DECIMAL = "."
+	defer func() { OPT_DECIMAL = "" }()
+
+	if q := Query().AmountEquals(12_05).String(); q != "(s=12.05)" {
+		t.Errorf("unexpected query %s", q)
+	}
+}
+
+func TestQueryInjection(t *testing.T) {
+	records := Collection{
+		{Sender: "magazin]+[a=x", Receiver: "b", Label: "c", Amount: 100},
+		{Sender: "magazin", Receiver: "b", Label: "c", Amount: 200},
+		{Sender: "x", Receiver: "b", Label: "c", Amount: 300},
+		{Sender: "a; b | c, d (e) \\ f", Receiver: "b", Label: "c", Amount: 400},
+	}
+
+	for name, amount := range map[string]int64{"magazin]+[a=x": 100, "a; b | c, d (e) \\ f": 400} {
+		q := Query().Sender(name).String()
+		if rs, err := records.Filter(q); err != nil || len(rs) != 1 || rs[0].Amount != amount {
+			t.Errorf("unexpected results for %s: %v, %v", q, rs, err)
+		}
+	}
+
+	if q := Escape("magazin]+[a=x"); q != `magazin\]+\[a=x` {
+		t.Errorf("unexpected escaped text %s", q)
+	}
+
+	literals := Collection{
+		{Sender: "/.*/", Receiver: "/(/", Label: "c", Amount: 100},
+		{Sender: "*x*", Receiver: "~b", Label: "c", Amount: 200},
+		{Sender: "x", Receiver: `"b"`, Label: "?", Amount: 300},
+		{Sender: "'x'", Receiver: "<empty>", Label: "", Amount: 400},
+	}
+
+	for q, amount := range map[string]int64{
+		Query().Sender("/.*/").String():      100,
+		Query().Receiver("/(/").String():     100,
+		Query().Sender("*x*").String():       200,
+		Query().Receiver("~b").String():      200,
+		Query().Receiver(`"b"`).String():     300,
+		Query().Label("?").String():          300,
+		Query().Sender("'x'").String():       400,
+		Query().Receiver("<empty>").String(): 400,
+	} {
+		if rs, err := literals.Filter(q); err != nil || len(rs) != 1 || rs[0].Amount != amount {
+			t.Errorf("unexpected results for %s: %v, %v", q, rs, err)
+		}
+	}
+
+	if q := Escape(" /x/"); q != ` \/x/` {
+		t.Errorf("unexpected escaped text %s", q)
+	}
+
+	if rs, err := records.Filter(`[a=/^magazin\]/]`); err != nil || len(rs) != 1 {
+		t.Errorf("unexpected results %v, %v", rs, err)
+	}
+
+	if _, err := records.Filter(`[a=x\]`); !errors.Is(err, ErrUnbalancedParens) {
+		t.Errorf("expected fail but got %v", err)
+	} else if err.Error() != "number of opened paranthesis don't match with closed ones" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestQuotedValues(t *testing.T) {
+	names := []string{"A, B & C]", "X; Y", "P + Q", "M [N]", "K (L)", "E | F", "G - H", "I\\J", "O'Neil, Inc"}
+
+	records := Collection{}
+	for i, name := range names {
+		records = append(records, Record{Sender: "s", Receiver: name, Label: "c", Amount: int64(i)})
+	}
+
+	for i, name := range names {
+		for _, q := range []string{`[b="` + name + `"]`, `[b='` + name + `']`, `[b=` + Escape(name) + `]`, `[s=0..100; b="` + name + `"]`} {
+			if rs, err := records.Filter(q); err != nil || len(rs) != 1 || rs[0].Amount != int64(i) {
+				t.Errorf("unexpected results for %s: %v, %v", q, rs, err)
+			}
+		}
+	}
+
+	if rs, err := records.Filter(`[b="A, B & C]", "X; Y"] + [b='K (L)']`); err != nil || len(rs) != 3 {
+		t.Errorf("unexpected results %v, %v", rs, err)
+	}
+
+	if rs, err := records.Filter(`[b="a, b & c]"]`); err != nil || len(rs) != 1 {
+		t.Errorf("unexpected results %v, %v", rs, err)
+	}
+
+	if rs, err := records.Filter(`[b='a, b & c]']`); err != nil || len(rs) != 0 {
+		t.Errorf("unexpected results %v, %v", rs, err)
+	}
+
+	if rs, err := collection.Filter(`[b="(magazin)"]`); err != nil || len(rs) != 9 {
+		t.Errorf("unexpected nr of results %d, %v", len(rs), err)
+	}
+}
+
+func TestFilterFunc(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	rounded := records.FilterFunc(func(r Record) bool {
+		return r.Amount%100_00 == 0
+	})
+
+	if len(rounded) != 7 {
+		t.Errorf("unexpected nr of results %d\n", len(rounded))
+	}
+
+	for i, r := range rounded {
+		if r.Amount%100_00 != 0 || i > 0 && r.Line < rounded[i-1].Line {
+			t.Errorf("unexpected record %v", r)
+		}
+	}
+
+	if rs := records.FilterFunc(func(r Record) bool { return utf8.RuneCountInString(r.Label) > 15 }); len(rs) != 1 || rs[0].Label != "Casă și curățenie" {
+		t.Errorf("unexpected results %v", rs)
+	}
+}
+
+// sliceReader yields rows from memory, without line positions
+type sliceReader struct {
+	rows [][]string
+}
+
+func (r *sliceReader) Read() ([]string, error) {
+	if len(r.rows) == 0 {
+		return nil, io.EOF
+	}
+
+	row := r.rows[0]
+	r.rows = r.rows[1:]
+
+	return row, nil
+}
+
+func TestRowReaders(t *testing.T) {
+	tsv := "Alexandru\t(magazin)\tAlimente\t2019-12-05\t-40.22\n" +
+		"Alexandru\t(magazin)\t20.00 Apa + 10.50 Pâine, cozonac\t2019-12-06\t-30.50\n"
+
+	fixed := "" +
+		"Alexandru (magazin) Alimente                          2019-12-05    -40.22\n" +
+		"\n" +
+		"Alexandru (magazin) 20.00 Apa + 10.50 Pâine, cozonac 2019-12-06    -30.50\n"
+
+	fromTSV, err := NewTSV(strings.NewReader(tsv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromFixed, err := NewFixedWidth(strings.NewReader(fixed), []int{10, 10, 34, 10, 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromRows, err := NewFromRowReader(&sliceReader{[][]string{
+		{"Alexandru", "(magazin)", "Alimente", "2019-12-05", "-40.22"},
+		{"Alexandru", "(magazin)", "20.00 Apa + 10.50 Pâine, cozonac", "2019-12-06", "-30.50"},
+	}}, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, all := range []Collection{fromTSV, fromFixed, fromRows} {
+		if len(all) != 3 {
+			t.Fatalf("unexpected records %v", all)
+		}
+
+		if all[0].Label != "Alimente" || all[0].Amount != -40_22 || all[2].Label != "Pâine, cozonac" || all[2].Amount != -10_50 || all[2].ParentAmount != -30_50 {
+			t.Errorf("unexpected records %v", all)
+		}
+	}
+
+	if fromFixed[2].Line != 3 || fromRows[2].Line != 2 || fromTSV[2].Line != 2 {
+		t.Errorf("unexpected lines %d, %d, %d", fromFixed[2].Line, fromRows[2].Line, fromTSV[2].Line)
+	}
+
+	if _, err := NewFixedWidth(strings.NewReader(fixed), []int{10, 0}); err == nil {
+		t.Error("expected fail but didn't")
+	}
+
+	if _, err := NewFixedWidth(strings.NewReader("Alexandru (magazin) Alimente\n"), []int{10, 10, 34, 10, 10}); err == nil {
+		t.Error("expected fail but didn't")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Normalize = func(field byte, raw string) string {
+		if field == HEADER_B_RECEIVER && strings.Contains(strings.ToLower(raw), "magazin") {
+			return "Magazin"
+		} else if field == HEADER_C_CATEGORY && raw == "" {
+			return "?"
+		}
+
+		return raw
+	}
+
+	src := "Alexandru,(magazin),Alimente,2019-12-05,-40.22\n" +
+		"Alexandru,MAGAZIN SRL,Alimente,2019-12-06,-10.00\n" +
+		"Alexandru,Magazin #2,5.00 Apa + 5.00,2019-12-07,-10.00\n" +
+		"Alexandru,Catrina,Împrumut,2019-12-08,-100.00\n"
+
+	all, err := NewWithOptions(strings.NewReader(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := all.GroupBy(HEADER_B_RECEIVER)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(groups) != 2 || groups["Magazin"] != -60_22 || groups["Catrina"] != -100_00 {
+		t.Errorf("unexpected groups %v", groups)
+	}
+
+	if all[3].Label != "?" || all[0].Sender != "Alexandru" {
+		t.Errorf("unexpected records %v", all)
+	}
+
+	if rs, _ := all.Filter(`[b="magazin"]`); len(rs) != 4 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+}
+
+func TestInconsistentColumns(t *testing.T) {
+	src := "a,b,c,2019-12-05,-100\na,b,c,2019-12-06,-100,extra\na,b,c,2019-12-07,-100\n"
+
+	_, err := NewSafe(strings.NewReader(src))
+	if !errors.Is(err, csv.ErrFieldCount) {
+		t.Fatalf("expected fail but got %v", err)
+	} else if !strings.HasPrefix(err.Error(), "row 2, ") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if errs := Validate(strings.NewReader(src)); len(errs) != 1 || !errors.Is(errs[0], csv.ErrFieldCount) {
+		t.Errorf("unexpected errors %v", errs)
+	}
+
+	next := NewStream(strings.NewReader(src))
+	var records, failures int
+	for {
+		if _, err := next(); err == io.EOF {
+			break
+		} else if err != nil {
+			failures++
+		} else {
+			records++
+		}
+	}
+
+	if records != 2 || failures != 1 {
+		t.Errorf("unexpected %d records and %d failures", records, failures)
+	}
+}
+
+func TestAmountTolerance(t *testing.T) {
+	records := Collection{
+		{Sender: "a", Receiver: "b", Label: "c", Amount: -95_00},
+		{Sender: "a", Receiver: "b", Label: "c", Amount: -100_00},
+		{Sender: "a", Receiver: "b", Label: "c", Amount: 104_99},
+		{Sender: "a", Receiver: "b", Label: "c", Amount: 105_01},
+		{Sender: "a", Receiver: "b", Label: "c", Amount: -100_40},
+	}
+
+	queries := map[string]int{
+		"[s = 100 ± 5]":       4,
+		"(s = 100 ± 5)":       4,
+		"[s = 100 +/- 5]":     4,
+		"[s = 100 ± 0,50]":    2,
+		"[s = 100 ± 0]":       1,
+		"[s != 100 ± 5]":      1,
+		"[v = -100 ± 5]":      3,
+		"[v = -100 +/- 0,40]": 2,
+		"[v = 100 ± 5,01]":    2,
+	}
+
+	for q, expected := range queries {
+		if rs, err := records.Filter(q); err != nil || len(rs) != expected {
+			t.Errorf("unexpected nr of results for %s: %d, %v", q, len(rs), err)
+		}
+
+		if rs, err := records.Index().Filter(q); err != nil || len(rs) != expected {
+			t.Errorf("unexpected nr of indexed results for %s: %d, %v", q, len(rs), err)
+		}
+	}
+
+	if _, err := records.Filter("[s > 100 ± 5]"); !errors.Is(err, ErrUnsupportedOperator) {
+		t.Errorf("expected fail but got %v", err)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Classify = func(r Record) string {
+		if r.Receiver == "(dentist)" {
+			return "Health"
+		} else if r.Amount < -50_00 {
+			return "Large"
+		}
+
+		return r.Label
+	}
+
+	src := "Alexandru,(dentist),?,2019-12-05,-200.00\n" +
+		"Alexandru,(dentist),Vizită dentist,2019-12-06,-850.00\n" +
+		"Alexandru,(magazin),10.00 Apa + 60.00 + 5.00 ?,2019-12-07,-75.00\n" +
+		"Alexandru,(dentist),,2019-12-08,-100.00\n"
+
+	all, err := NewWithOptions(strings.NewReader(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rs, _ := all.Filter("[c=health]"); len(rs) != 2 {
+		t.Errorf("unexpected nr of results %d\n", len(rs))
+	}
+
+	labels := []string{"Health", "Vizită dentist", "Apa", "Large", "?", "Health"}
+	for i, r := range all {
+		if r.Label != labels[i] {
+			t.Errorf("unexpected label %q for %v", r.Label, r)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	records := New(strings.NewReader(sample))
+	original := fmt.Sprint(records)
+
+	clone := records.Clone()
+	if fmt.Sprint(clone) != original {
+		t.Fatal("expected clone to match the original")
+	}
+
+	clone[0].Sender = "y"
+	clone = append(clone, Record{Sender: "z"})
+	if fmt.Sprint(records) != original {
+		t.Error("expected clone to be unaffected by the original and the other way around")
+	}
+
+	if len(clone) != len(records)+1 || (Collection)(nil).Clone() != nil {
+		t.Errorf("unexpected clone length %d", len(clone))
+	}
+}
+
+func TestResultsDontAlias(t *testing.T) {
+	records := New(strings.NewReader(sample))
+	records = records[:len(records)-5] // room to append in place
+	original := fmt.Sprint(records[:cap(records)])
+
+	for _, q := range []string{"", "[]", "[a=alex] + [b=alex]", "[] - [c=?]"} {
+		rs, err := records.Filter(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rs = append(rs, Record{Sender: "x"})
+		rs[0].Sender = "y"
+		if fmt.Sprint(records[:cap(records)]) != original {
+			t.Fatalf("filter %q changed the source collection", q)
+		}
+	}
+
+	page := records.Page(0, 2)
+	page = append(page, Record{Sender: "x"})
+	page[0].Sender = "y"
+	if fmt.Sprint(records[:cap(records)]) != original {
+		t.Error("page changed the source collection")
+	}
+}
+
+func TestYearMonth(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	rs, err := records.Filter("[d=2019-12]")
+	if err != nil || len(rs) != 15 {
+		t.Errorf("unexpected nr of results %d, %v", len(rs), err)
+	}
+
+	for _, r := range rs {
+		if r.Date.Year() != 2019 || r.Date.Month() != time.December {
+			t.Errorf("unexpected record %v", r)
+		}
+	}
+
+	if rs2, _ := records.Filter("[d=2019-12-01..2019-12-31]"); fmt.Sprint(rs) != fmt.Sprint(rs2) {
+		t.Errorf("expected same results as the range, got %d", len(rs2))
+	}
+
+	if rs, _ := records.Filter("(d>2019-11; d<2020-01)"); len(rs) != 15 {
+		t.Errorf("unexpected nr of results %d", len(rs))
+	}
+
+	if rs, _ := records.Filter("[d=2019-13]"); len(rs) != 0 {
+		t.Errorf("unexpected nr of results %d", len(rs))
+	}
+}
+
+func TestQuarters(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	rs, err := records.Filter("[d=Q4 2019]")
+	if err != nil || len(rs) != 36 {
+		t.Errorf("unexpected nr of results %d, %v", len(rs), err)
+	}
+
+	for _, r := range rs {
+		if r.Date.Year() != 2019 || r.Date.Month() < time.October {
+			t.Errorf("unexpected record %v", r)
+		}
+	}
+
+	pairs := [][2]string{
+		{"[d=q4 2019]", "[d=2019-10-01..2019-12-31]"},
+		{"[d=H2 2019]", "[d=2019-07-01..2019-12-31]"},
+		{"[d=Q1 2020]", "[d=2020-01-01..2020-03-31]"},
+		{"[d>Q4 2019]", "[d>2019-10-01]"},
+		{"(d>Q4 2019)", "(d>2019-12-31)"},
+		{"(d<Q1 2020]", "(d<2020-03-31]"},
+	}
+
+	for _, pair := range pairs {
+		rs1, err1 := records.Filter(pair[0])
+		rs2, err2 := records.Filter(pair[1])
+		if err1 != nil || err2 != nil || len(rs1) == 0 || fmt.Sprint(rs1) != fmt.Sprint(rs2) {
+			t.Errorf("expected %s to match %s but got %d and %d", pair[0], pair[1], len(rs1), len(rs2))
+		}
+	}
+
+	if rs, _ := records.Filter("[d=H3 2019]"); len(rs) != 0 {
+		t.Errorf("unexpected nr of results %d", len(rs))
+	}
+}
+
+func TestLocaleSeparators(t *testing.T) {
+	german := &Locale{DecimalSep: ",", GroupingSep: "."}
+
+	defer Setup(CurrentLocale())
+	Setup(german)
+
+	all, err := NewSafe(strings.NewReader("a,b,c,2019-12-05,\"-27,73\"\na,b,c,2019-12-06,\"1.234,56\"\na,b,c,2019-12-07,\"1.500,00\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	} else if all[0].Amount != -27_73 || all[1].Amount != 1_234_56 || all[2].Amount != 1_500_00 {
+		t.Errorf("unexpected amounts %v, %v, %v", all[0].Amount, all[1].Amount, all[2].Amount)
+	}
+
+	if rs, _ := all.FilterWithLocale("[s=1.234,56]", german); len(rs) != 1 || rs[0].Amount != 1_234_56 {
+		t.Errorf("unexpected results %v\n", rs)
+	}
+
+	if rs, _ := all.FilterWithLocale("[s=27,73, 1.500]", german); len(rs) != 2 {
+		t.Errorf("unexpected results %v\n", rs)
+	}
+
+	if rs, _ := all.FilterWithLocale("[s>1.000]", german); len(rs) != 2 {
+		t.Errorf("unexpected results %v\n", rs)
+	}
+}
+
+func TestFind(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	r, found, err := records.Find("[c=transfer]")
+	if err != nil || !found {
+		t.Fatalf("expected to find a record but got %v", err)
+	} else if r.Label != "Transfer" || r.Date.Format("2006-01-02") != "2019-11-27" {
+		t.Errorf("unexpected record %v", r)
+	}
+
+	if rs, _ := records.Filter("[c=transfer]"); !rs[0].Equal(r) {
+		t.Errorf("expected %v to be the first result but got %v", rs[0], r)
+	}
+
+	if _, found, err := records.Find("[c=nothing like this]"); err != nil || found {
+		t.Errorf("unexpected result %v, %v", found, err)
+	}
+
+	if _, _, err := records.Find("[c=transfer"); err == nil {
+		t.Error("expected query to fail")
+	}
+}
+
+func TestTransactionType(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	pairs := map[string]string{
+		"[t=income]":           "[z>0]",
+		"[t=expense]":          "[z<0]",
+		"[t=Expense; s>1000]":  "[s>1000; z<0]",
+		"[t=income | a=alex]":  "[z>0 | a=alex]",
+		"(t=expense; v<-1000)": "(v<-1000)",
+	}
+
+	for q1, q2 := range pairs {
+		rs1, err1 := records.Filter(q1)
+		rs2, err2 := records.Filter(q2)
+		if err1 != nil || err2 != nil || len(rs1) == 0 || fmt.Sprint(rs1) != fmt.Sprint(rs2) {
+			t.Errorf("expected %s to match %s but got %d and %d (%v, %v)", q1, q2, len(rs1), len(rs2), err1, err2)
+		}
+	}
+
+	for _, q := range []string{"[t=refund]", "[t>income]", "[t!=income]"} {
+		if _, err := records.Filter(q); err == nil {
+			t.Errorf("expected %s to fail", q)
+		}
+	}
+}
+
+func TestFilterExplain(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	matches, err := records.FilterExplain("[a=catrina] + [b=catrina]")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(matches) != 8 {
+		t.Errorf("unexpected nr of results %d", len(matches))
+	}
+
+	rs, _ := records.Filter("[a=catrina] + [b=catrina]")
+	for i, m := range matches {
+		if !m.Record.Equal(rs[i]) {
+			t.Errorf("expected the same order as Filter but got %v instead of %v", m.Record, rs[i])
+		}
+
+		if strings.HasPrefix(strings.ToLower(m.Record.Sender), "catrina") && (m.Formula != 0 || m.Source != "[a=catrina]") {
+			t.Errorf("unexpected formula %d %s for %v", m.Formula, m.Source, m.Record)
+		} else if strings.HasPrefix(strings.ToLower(m.Record.Receiver), "catrina") && (m.Formula != 1 || m.Source != "[b=catrina]") {
+			t.Errorf("unexpected formula %d %s for %v", m.Formula, m.Source, m.Record)
+		}
+	}
+
+	if matches, _ := records.FilterExplain("(b=catrina] + [a=catrina; s>0) + [b=catrina]"); len(matches) != 8 || matches[0].Source != "[a=catrina; s>0)" && matches[0].Source != "(b=catrina]" {
+		t.Errorf("unexpected results %v", matches)
+	}
+
+	// catrina's alimente records are removed, so they come from the last formula
+	matches, err = records.FilterExplain("[c=alimente] - [a=catrina] + [a=catrina]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, _ = records.Filter("[c=alimente] + [a=catrina]")
+	if len(matches) != len(rs) {
+		t.Errorf("unexpected nr of results %d instead of %d", len(matches), len(rs))
+	}
+
+	for _, m := range matches {
+		if catrina := strings.HasPrefix(strings.ToLower(m.Record.Sender), "catrina"); catrina && (m.Formula != 2 || m.Source != "[a=catrina]") {
+			t.Errorf("unexpected formula %d %s for %v", m.Formula, m.Source, m.Record)
+		} else if !catrina && (m.Formula != 0 || m.Source != "[c=alimente]") {
+			t.Errorf("unexpected formula %d %s for %v", m.Formula, m.Source, m.Record)
+		}
+	}
+
+	if matches, _ := records.FilterExplain("([a=catrina] & [c=alimente]) + [c=alimente]"); len(matches) == 0 {
+		t.Error("expected results")
+	} else {
+		for _, m := range matches {
+			if catrina := strings.HasPrefix(strings.ToLower(m.Record.Sender), "catrina"); catrina && m.Formula != 0 || !catrina && m.Formula != 2 {
+				t.Errorf("unexpected formula %d %s for %v", m.Formula, m.Source, m.Record)
+			}
+		}
+	}
+
+	for _, q := range []string{"", "   "} {
+		if matches, err := records.FilterExplain(q); err != nil || len(matches) != len(records) {
+			t.Errorf("unexpected results for %q: %d, %v", q, len(matches), err)
+		} else if matches[0].Formula != -1 || matches[0].Source != "" {
+			t.Errorf("unexpected formula %d %s for %v", matches[0].Formula, matches[0].Source, matches[0].Record)
+		}
+	}
+
+	if _, err := records.FilterExplain("[a=catrina"); err == nil {
+		t.Error("expected query to fail")
+	}
+}
+
+func TestValidateQuery(t *testing.T) {
+	invalid := map[string]error{
+		"[a=alex":               ErrUnbalancedParens,
+		"[a=alex] + (b=catrina": ErrUnbalancedParens,
+		"[a=alex] +":            ErrIncorrectQuery,
+		"[q=alex]":              ErrUnknownHeader,
+		"[a=alex; q>10]":        ErrUnknownHeader,
+		"[w>monday]":            ErrUnsupportedOperator,
+		"[a=alex | z=0]":        ErrUnsupportedOperator,
+		"[w=someday]":           ErrInvalidValue,
+		"[a=alex,]":             ErrInvalidValue,
+		"[a=, alex]":            ErrInvalidValue,
+		"[b=alex,,catrina]":     ErrInvalidValue,
+		"[p=maybe]":             ErrInvalidValue,
+		"[t=refund]":            ErrInvalidValue,
+		"[u=alex]":              ErrInvalidValue,
+		"[z=positive]":          ErrInvalidValue,
+		"[s=abc]":               ErrInvalidValue,
+		"[s=10~abc]":            ErrInvalidValue,
+		"[v=abc..100]":          ErrInvalidValue,
+		`[a=/(/]`:               ErrInvalidValue,
+	}
+
+	for q, kind := range invalid {
+		if err := ValidateQuery(q); !errors.Is(err, kind) {
+			t.Errorf("expected %s to fail with %v but got %v", q, kind, err)
+		}
+	}
+
+	if rs, err := New(strings.NewReader(sample)).Filter("[a=alex,]"); err == nil || len(rs) != 0 {
+		t.Errorf("expected trailing comma to fail but got %d results", len(rs))
+	}
+
+	var qe *QueryError
+	if _, err := New(strings.NewReader(sample)).Filter("[w=someday]"); !errors.As(err, &qe) || qe.Token != "someday" || err.Error() != "not a weekday someday" {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	for _, q := range []string{"", "[a=alex]", "[a=alex] + ([b=catrina] - [s>1000; z<0])", "[d=2019-12; w=monday | v<-10]", "[t=income]"} {
+		if err := ValidateQuery(q); err != nil {
+			t.Errorf("unexpected error for %s: %v", q, err)
+		}
+	}
+}
+
+func TestNegativeSums(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	pairs := map[string]string{
+		"[s<-1000]":  "[s>1000; z<0]",
+		"(s<-1000)":  "(s>1000; z<0)",
+		"[s=-1000]":  "[s=1000; z<0]",
+		"(s>-1000)":  "(s<1000; z<0) + [z>0]",
+		"(s=-40,22)": "(v=-40,22)",
+
+		"[s=-500..-100]":  "[v=-500..-100]",
+		"(s=-500..-100)":  "(v=-500..-100)",
+		"[s=-500..1000]":  "[v=-500..1000]",
+		"[s=-100 ± 5]":    "[v=-100 ± 5]",
+		"[s!=-100 +/- 5]": "[v!=-100 +/- 5]",
+	}
+
+	for signed, unsigned := range pairs {
+		rs1, err1 := records.Filter(signed)
+		rs2, err2 := records.Filter(unsigned)
+		if err1 != nil || err2 != nil || len(rs1) == 0 || fmt.Sprint(rs1) != fmt.Sprint(rs2) {
+			t.Errorf("expected %s to match %s but got %d and %d (%v, %v)", signed, unsigned, len(rs1), len(rs2), err1, err2)
+		}
+	}
+
+	// without the sign it's the absolute amount
+	if rs1, _ := records.Filter("[s>1000]"); len(rs1) != 7 {
+		t.Errorf("unexpected nr of results %d", len(rs1))
+	}
+}
+
+func TestMerge(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	first, second := records[:30], records[20:]
+	merged := Merge(first, second)
+	if len(merged) != len(records.Dedup()) {
+		t.Fatalf("unexpected nr of records %d", len(merged))
+	}
+
+	for i, r := range records.Dedup() {
+		if !merged[i].Equal(r) {
+			t.Errorf("unexpected record %v instead of %v", merged[i], r)
+		}
+	}
+
+	if merged := Merge(second, nil, first[:5]); len(merged) != len(second)+5 || !merged[len(second)].Equal(records[0]) {
+		t.Errorf("unexpected merge %v", merged)
+	}
+
+	if merged := Merge(); len(merged) != 0 {
+		t.Errorf("unexpected merge %v", merged)
+	}
+}
+
+func TestFilterRaw(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	for _, q := range []string{"[a=alex]", "[c=?] + [b=magazin]", "[d=2019-12] - [s>100]", ""} {
+		sorted, err1 := records.Filter(q)
+		raw, err2 := records.FilterRaw(q)
+		if err1 != nil || err2 != nil || len(sorted) != len(raw) {
+			t.Fatalf("unexpected results for %s: %d and %d (%v, %v)", q, len(sorted), len(raw), err1, err2)
+		}
+
+		keys := make(map[string]int)
+		for _, r := range sorted {
+			keys[OPT_RECORD_KEY(r)]++
+		}
+
+		for _, r := range raw {
+			if keys[OPT_RECORD_KEY(r)]--; keys[OPT_RECORD_KEY(r)] < 0 {
+				t.Errorf("unexpected record %v for %s", r, q)
+			}
+		}
+	}
+
+	// a single formula keeps the order of the collection
+	if raw, _ := records.FilterRaw("[a=alex]"); !raw[0].Equal(records.FilterFunc(func(r Record) bool { return strings.HasPrefix(r.Sender, "Alex") })[0]) {
+		t.Errorf("unexpected first record %v", raw[0])
+	}
+
+	if _, err := records.FilterRaw("[a=alex"); err == nil {
+		t.Error("expected query to fail")
+	}
+}
+
+func TestEscapedSeparator(t *testing.T) {
+	data := `a,b,"10.00 A\+ rating fee + 5.00 other fees",2019-12-05,-15.00
+a,b,"C\+\+ books",2019-12-06,-20.00
+`
+
+	all, err := NewSafe(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(all) != 3 {
+		t.Fatalf("unexpected nr of records %d", len(all))
+	}
+
+	if all[0].Label != "A+ rating fee" || all[0].Amount != -10_00 || all[1].Label != "other fees" || all[1].Amount != -5_00 {
+		t.Errorf("unexpected split records %v, %v", all[0], all[1])
+	} else if all[0].RawLabel != `10.00 A\+ rating fee + 5.00 other fees` {
+		t.Errorf("unexpected raw label %q", all[0].RawLabel)
+	}
+
+	if all[2].Label != "C++ books" || all[2].Amount != -20_00 || all[2].Part != 0 {
+		t.Errorf("unexpected record %v", all[2])
+	}
+
+	if rs, _ := all.Filter("[c=a+ rating]"); len(rs) != 1 {
+		t.Errorf("unexpected nr of results %d", len(rs))
+	}
+}
+
+func TestTags(t *testing.T) {
+	records := New(strings.NewReader(sample))
+	if records[0].Tags != nil {
+		t.Errorf("unexpected tags %v", records[0].Tags)
+	}
+
+	for i := range records {
+		if strings.HasPrefix(records[i].Sender, "Catrina") {
+			records[i].Tags = []string{"reviewed"}
+		} else if strings.HasPrefix(records[i].Receiver, "Catrina") {
+			records[i].Tags = []string{"reviewed", "Disputed"}
+		}
+	}
+
+	rs, err := records.Filter("[a=catrina] + [b=catrina]")
+	if err != nil || len(rs) != 8 {
+		t.Fatalf("unexpected results %v, %v", rs, err)
+	}
+
+	for _, r := range append(rs.Page(0, 8), rs.SortBy("amount", true)...) {
+		if len(r.Tags) == 0 || r.Tags[0] != "reviewed" {
+			t.Errorf("expected tags on %v", r)
+		}
+	}
+
+	if rs, _ := records.Filter("[g=disputed]"); len(rs) != 2 {
+		t.Errorf("unexpected nr of results %d", len(rs))
+	}
+
+	if rs, _ := records.Filter("[g=Reviewed; g!=disputed]"); len(rs) != 6 {
+		t.Errorf("unexpected nr of results %d", len(rs))
+	}
+
+	if rs, _ := records.Filter("[g=other, disputed]"); len(rs) != 2 {
+		t.Errorf("unexpected nr of results %d", len(rs))
+	}
+
+	if clone := rs.Clone(); &clone[0].Tags[0] == &rs[0].Tags[0] {
+		t.Error("expected clone to copy the tags")
+	}
+}
+
+func TestInternalTransfers(t *testing.T) {
+	data := `Alexandru,Alexandru Savings,Transfer,2019-12-01,-500.00
+Alexandru,Alexandru Savings,Transfer,2019-12-02,500.00
+Alexandru,Alexandru Savings,Transfer,2019-12-20,500.00
+Alexandru Savings,Alexandru,Transfer,2019-12-10,-200.00
+Alexandru,Alexandru Savings,Transfer,2019-12-11,200.00
+Alexandru,Catrina,Transfer,2019-12-12,-300.00
+Catrina,Alexandru,Transfer,2019-12-12,300.00
+Alexandru Savings,Alexandru,Transfer,2019-12-15,-100.00
+Alexandru Savings,Alexandru,Transfer,2019-12-25,100.00
+`
+	records := New(strings.NewReader(data))
+
+	pairs := records.InternalTransfers([]string{"alexandru", "Alexandru Savings"})
+	if len(pairs) != 4 {
+		t.Fatalf("unexpected nr of records %d: %v", len(pairs), pairs)
+	}
+
+	if !pairs[0].Equal(records[0]) || !pairs[1].Equal(records[1]) || !pairs[2].Equal(records[3]) || !pairs[3].Equal(records[4]) {
+		t.Errorf("unexpected pairs %v", pairs)
+	}
+
+	OPT_TRANSFER_DAYS = 10
+	defer func() { OPT_TRANSFER_DAYS = 3 }()
+
+	if pairs := records.InternalTransfers([]string{"alexandru", "Alexandru Savings"}); len(pairs) != 6 {
+		t.Errorf("unexpected nr of records %d: %v", len(pairs), pairs)
+	}
+
+	if pairs := records.InternalTransfers(nil); len(pairs) != 0 {
+		t.Errorf("unexpected pairs %v", pairs)
+	}
+}
+
+func TestParseErrorPanic(t *testing.T) {
+	recovered := func(data string) (parseErr *ParseError) {
+		defer func() {
+			parseErr, _ = recover().(*ParseError)
+		}()
+
+		New(strings.NewReader(data))
+		return nil
+	}
+
+	parseErr := recovered("a,b,c,2019-12-05,-27.73\na,b,c,2019-12-06,not an amount\n")
+	if parseErr == nil {
+		t.Fatal("expected to panic with a parse error")
+	} else if parseErr.Line != 2 || len(parseErr.Row) != 5 || parseErr.Row[4] != "not an amount" {
+		t.Errorf("unexpected parse error %#v", parseErr)
+	} else if !strings.HasPrefix(parseErr.Error(), "row 2, ") || parseErr.Err == nil {
+		t.Errorf("unexpected error %v", parseErr)
+	}
+
+	if parseErr := recovered("a,b,c\n"); parseErr == nil || !errors.Is(parseErr, ErrMissingColumns) || parseErr.Row[2] != "c" {
+		t.Errorf("unexpected parse error %v", parseErr)
+	}
+
+	if _, err := NewSafe(strings.NewReader("a,b,c\n")); !errors.As(err, &parseErr) || parseErr.Line != 1 {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if err := (&ParseError{Err: ErrMissingColumns}); err.Error() != ErrMissingColumns.Error() {
+		t.Errorf("unexpected error %q", err)
+	}
+}
+
+func TestNewAuto(t *testing.T) {
+	var archive bytes.Buffer
+	w := gzip.NewWriter(&archive)
+	if _, err := w.Write([]byte(sample)); err != nil {
+		t.Fatal(err)
+	} else if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := New(strings.NewReader(sample))
+	for _, src := range []io.Reader{&archive, strings.NewReader(sample)} {
+		all, err := NewAuto(src)
+		if err != nil {
+			t.Fatal(err)
+		} else if fmt.Sprint(all) != fmt.Sprint(records) {
+			t.Errorf("unexpected records %v", all)
+		}
+	}
+
+	if _, err := NewAuto(bytes.NewReader([]byte{0x1f, 0x8b, 0, 0})); err == nil {
+		t.Error("expected a broken archive to fail")
+	}
+
+	if all, err := NewAuto(strings.NewReader("")); err != nil || len(all) != 0 {
+		t.Errorf("unexpected records %v, %v", all, err)
+	}
+}
+
+func TestByMonth(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	expected := []MonthBucket{
+		{2019, time.October, 39_398_17, 12},
+		{2019, time.November, 8_977_59, 9},
+		{2019, time.December, -832_68, 15},
+		{2020, time.January, -653_66, 6},
+	}
+
+	buckets := records.SortBy("amount", false).ByMonth()
+	if fmt.Sprint(buckets) != fmt.Sprint(expected) {
+		t.Errorf("unexpected buckets %v", buckets)
+	}
+
+	if buckets := (Collection{}).ByMonth(); len(buckets) != 0 {
+		t.Errorf("unexpected buckets %v", buckets)
+	}
+}
+
+func TestSingleDecimalSums(t *testing.T) {
+	all := New(strings.NewReader("a,b,c,2019-12-05,-40.20\na,b,c,2019-12-06,4.02\na,b,c,2019-12-07,40.29\n"))
+
+	for _, q := range []string{"[s=40,2]", "[s=40,20]", "[v=-40,2]", "[s=40,1..40,2]", "[s=40,15 ± 0,05]"} {
+		if rs, err := all.Filter(q); err != nil || len(rs) != 1 || rs[0].Amount != -40_20 {
+			t.Errorf("unexpected results for %s: %v, %v", q, rs, err)
+		}
+	}
+
+	if rs, _ := all.Filter("[s=40]"); len(rs) != 2 {
+		t.Errorf("unexpected nr of results %d", len(rs))
+	}
+
+	OPT_AMOUNT_SCALE = 3
+	defer func() { OPT_AMOUNT_SCALE = 2 }()
+
+	if sum, _, err := parseSum([]byte("40,2"), CurrentLocale()); err != nil || sum != 40_200 {
+		t.Errorf("unexpected sum %v, %v", sum, err)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	queries := map[string][]Token{
+		"[a=alex]":          {{"a=alex", true, 0b11}},
+		"(s>100; z<0]":      {{"s>100; z<0", true, 0b01}},
+		`[b=a\; b] - [c=?]`: {{"b=a; b", true, 0b11}, {"-", false, 0}, {"c=?", true, 0b11}},
+		"([a=x] + (b=y)) & [d=2019]": {
+			{"(", false, 0}, {"a=x", true, 0b11}, {"+", false, 0}, {"b=y", true, 0}, {")", false, 0},
+			{"&", false, 0}, {"d=2019", true, 0b11},
+		},
+		"": {},
+	}
+
+	for q, expected := range queries {
+		if tokens, err := Compile(q); err != nil {
+			t.Errorf("unexpected error for %s: %v", q, err)
+		} else if fmt.Sprint(tokens) != fmt.Sprint(expected) {
+			t.Errorf("unexpected tokens for %s: %v", q, tokens)
+		}
+	}
+
+	if _, err := Compile("[a=alex"); !errors.Is(err, ErrUnbalancedParens) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestUncategorized(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	if rs, err := records.Filter("[u=?]"); err != nil || len(rs) != 11 {
+		t.Errorf("unexpected nr of results %d, %v", len(rs), err)
+	} else if rs2, _ := records.Filter("[c=?]"); fmt.Sprint(rs) != fmt.Sprint(rs2) {
+		t.Errorf("unexpected results %v", rs)
+	}
+
+	if rs, _ := records.Filter("[u!=?]"); len(rs) != len(records)-11 {
+		t.Errorf("unexpected nr of results %d", len(rs))
+	}
+
+	all := New(strings.NewReader("?,b,c,2019-12-05,-1\na,,c,2019-12-06,-2\na,b, ? ,2019-12-07,-3\na,b,c,2019-12-08,-4\n"))
+	if rs, _ := all.Filter("[u=<empty>]"); len(rs) != 3 {
+		t.Errorf("unexpected nr of results %d", len(rs))
+	}
+
+	for _, q := range []string{"[u=alex]", "[u>?]"} {
+		if _, err := all.Filter(q); err == nil {
+			t.Errorf("expected %s to fail", q)
+		}
+	}
+}
+
+func TestBothAndNeitherParties(t *testing.T) {
+	data := `Alexandru,Alexandru Savings,Transfer,2019-12-01,-500.00
+Alexandru,Catrina,Transfer,2019-12-02,-300.00
+Catrina,Alexandru,Transfer,2019-12-03,300.00
+Catrina,(magazin),Food,2019-12-04,-50.00
+Ordonator,(magazin),Refund,2019-12-05,50.00
+`
+	records := New(strings.NewReader(data))
+
+	expected := map[string]int{
+		"[y=alexandru]":                      1,
+		"[y!=alexandru]":                     4,
+		"[y=alexandru, catrina]":             3,
+		"[n=alexandru]":                      2,
+		"[n=alexandru, catrina]":             1,
+		"[n!=alexandru]":                     3,
+		"[y=catrina, magazin]":               1,
+		`[y=/^(alex|catrina)/]`:              3,
+		"[y=alexandru; n=catrina]":           1,
+		"[y=alexandru] + [n=alex]":           3,
+		"[x=magazin] - [y=catrina, magazin]": 1,
+	}
+
+	for q, count := range expected {
+		if rs, err := records.Filter(q); err != nil || len(rs) != count {
+			t.Errorf("unexpected nr of results for %s: %d, %v", q, len(rs), err)
+		}
+
+		if rs, err := records.Index().Filter(q); err != nil || len(rs) != count {
+			t.Errorf("unexpected nr of indexed results for %s: %d, %v", q, len(rs), err)
+		}
+	}
+
+	if _, err := records.Filter("[y>alexandru]"); err == nil {
+		t.Error("expected query to fail")
+	}
+}
+
+func TestDayFirst(t *testing.T) {
+	all := New(strings.NewReader("a,b,c,2020-10-01,-1\na,b,c,2020-01-10,-2\na,b,c,2020-01-13,-3\n"))
+
+	expected := map[string]int64{"[d=01/10/2020]": -1, "[d=13/01/2020]": -3, "[d=01/13/2020]": -3}
+	for q, amount := range expected {
+		if rs, err := all.Filter(q); err != nil || len(rs) != 1 || rs[0].Amount != amount {
+			t.Errorf("unexpected results for %s: %v, %v", q, rs, err)
+		}
+	}
+
+	OPT_DAY_FIRST = false
+	defer func() { OPT_DAY_FIRST = true }()
+
+	expected = map[string]int64{"[d=01/10/2020]": -2, "[d=13/01/2020]": -3, "[d=01/13/2020]": -3, "[d=10.01.2020]": -1}
+	for q, amount := range expected {
+		if rs, err := all.Filter(q); err != nil || len(rs) != 1 || rs[0].Amount != amount {
+			t.Errorf("unexpected results for %s: %v, %v", q, rs, err)
+		}
+	}
+
+	if rs, _ := all.Filter("[d=13/13/2020]"); len(rs) != 0 {
+		t.Errorf("unexpected results %v", rs)
+	}
+}
+
+func TestMonthNameAnyYear(t *testing.T) {
+	defer Setup(CurrentLocale())
+	Setup(&Locale{Months: calendar})
+
+	all := New(strings.NewReader("a,b,c,2018-12-24,-1\na,b,c,2019-12-25,-2\na,b,c,2019-11-30,-3\na,b,c,2020-01-01,-4\n"))
+
+	// without OPT_ANY_YEAR the month is the last one that already started
+	last := time.Now().Year() - 1
+	if time.Now().Month() == time.December {
+		last++
+	}
+
+	recent := New(strings.NewReader(fmt.Sprintf("a,b,c,%d-12-24,-1\na,b,c,%d-12-25,-2\na,b,c,%d-11-30,-3\n", last-1, last, last)))
+	if rs, err := recent.Filter("[d=decembrie]"); err != nil || len(rs) != 1 || rs[0].Amount != -2 {
+		t.Errorf("unexpected results %v, %v", rs, err)
+	}
+
+	OPT_ANY_YEAR = true
+	defer func() { OPT_ANY_YEAR = false }()
+
+	if rs, err := all.Filter("[d=decembrie]"); err != nil || len(rs) != 2 || rs[0].Amount != -2 || rs[1].Amount != -1 {
+		t.Errorf("unexpected results %v, %v", rs, err)
+	}
+
+	if rs, err := all.Index().Filter("[d=decembrie]"); err != nil || len(rs) != 2 {
+		t.Errorf("unexpected indexed results %v, %v", rs, err)
+	}
+
+	if rs, _ := all.Filter("[d!=decembrie]"); len(rs) != 2 {
+		t.Errorf("unexpected nr of results %d", len(rs))
+	}
+
+	if rs, _ := all.Filter("[d=decembrie, noiembrie]"); len(rs) != 3 {
+		t.Errorf("unexpected nr of results %d", len(rs))
+	}
+}
+
+func TestReduce(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	merchants := Reduce(records, map[string]int{}, func(acc map[string]int, r Record) map[string]int {
+		if r.Amount < 0 {
+			acc[r.Receiver]++
+		}
+		return acc
+	})
+
+	if merchants["(hypermarket)"] != 11 || merchants["(magazin)"] != 9 || merchants["(supermarket)"] != 5 {
+		t.Errorf("unexpected merchants %v", merchants)
+	}
+
+	total := Reduce(records, int64(0), func(acc int64, r Record) int64 { return acc + r.Amount })
+	if total != records.Sum() || total != 46_889_42 {
+		t.Errorf("unexpected total %d", total)
+	}
+
+	if n := Reduce(Collection{}, 42, func(acc int, r Record) int { return acc + 1 }); n != 42 {
+		t.Errorf("unexpected result %d", n)
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	top := records.TopPercentile(5)
+	if len(top) != 3 {
+		t.Fatalf("unexpected nr of records %d", len(top))
+	}
+
+	for _, r := range top {
+		if abs(r.Amount) < 9_000_00 {
+			t.Errorf("unexpected record %v", r)
+		}
+	}
+
+	// three records of 1000 are at the threshold
+	if top := records.TopPercentile(10); len(top) != 7 || records.FilterFunc(func(r Record) bool { return abs(r.Amount) >= 1_000_00 }).Sum() != top.Sum() {
+		t.Errorf("unexpected records %v", top)
+	}
+
+	if bottom := records.BottomPercentile(5); len(bottom) != 3 || bottom.Max() > 0 || bottom.Min() < -12_00 {
+		t.Errorf("unexpected records %v", bottom)
+	}
+
+	if all := records.TopPercentile(100); len(all) != len(records) {
+		t.Errorf("unexpected nr of records %d", len(all))
+	}
+
+	if none := records.BottomPercentile(0); len(none) != 0 {
+		t.Errorf("unexpected records %v", none)
+	} else if none := (Collection{}).TopPercentile(50); len(none) != 0 {
+		t.Errorf("unexpected records %v", none)
+	}
+}
+
+func TestDebitCredit(t *testing.T) {
+	data := `Alexandru,(magazin),Food,2019-12-05,27.73,D
+Ordonator,Alexandru,Salary,2019-12-06,"1,000.00",c
+Alexandru,(magazin),"10.00 Food + 5.00 Drinks",2019-12-07,15.00, D
+`
+	opts := DefaultOptions()
+	opts.DebitCredit = &DebitCredit{Column: 5}
+
+	all, err := NewWithOptions(strings.NewReader(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(all) != 4 {
+		t.Fatalf("unexpected nr of records %d", len(all))
+	}
+
+	if all[0].Amount != -27_73 || all[1].Amount != 1_000_00 || all[2].Amount != -10_00 || all[3].Amount != -5_00 {
+		t.Errorf("unexpected amounts %v", all)
+	}
+
+	opts.DebitCredit = &DebitCredit{Column: 5, Debit: "DR", Credit: "CR"}
+	if _, err := NewWithOptions(strings.NewReader(data), opts); err == nil || !strings.HasPrefix(err.Error(), "row 1, column 5") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	opts.DebitCredit = &DebitCredit{Column: 6}
+	if _, err := NewWithOptions(strings.NewReader(data), opts); !errors.Is(err, ErrMissingColumns) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	opts.DebitCredit = &DebitCredit{Column: -1}
+	if _, err := NewWithOptions(strings.NewReader(data), opts); err == nil {
+		t.Error("expected a negative column to fail")
+	}
+}
+
+func TestDateRange(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	first, last := records.DateRange()
+	if first.Format("2006-01-02") != "2019-10-03" || last.Format("2006-01-02") != "2020-01-11" {
+		t.Errorf("unexpected range %v, %v", first, last)
+	}
+
+	if !records.IsChronological() {
+		t.Error("expected records to be chronological")
+	}
+
+	rs, _ := records.Filter("[a=alex]")
+	if first, last := rs.DateRange(); first.Before(records[0].Date) || last.After(records[len(records)-1].Date) {
+		t.Errorf("unexpected range %v, %v", first, last)
+	} else if rs.IsChronological() {
+		t.Error("expected filtered records to go the other way")
+	}
+
+	if first, last := (Collection{}).DateRange(); !first.IsZero() || !last.IsZero() {
+		t.Errorf("unexpected range %v, %v", first, last)
+	} else if !(Collection{}).IsChronological() {
+		t.Error("expected an empty collection to be chronological")
+	}
+}
+
+func TestWordPrefix(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	expected := map[string]int{
+		"[c=online]":          0,
+		"[c=~online]":         1,
+		"[c=~onl, ~dentist]":  5,
+		"[c=~produse online]": 1,
+		"[c=~cur]":            1,
+		"[c=~curatenie]":      1,
+		"[c=~ALI]":            7,
+		"[c=~entist]":         0,
+		"[c!=~dentist]":       len(records) - 4,
+	}
+
+	for q, count := range expected {
+		if rs, err := records.Filter(q); err != nil || len(rs) != count {
+			t.Errorf("unexpected nr of results for %s: %d, %v", q, len(rs), err)
+		}
+	}
+
+	all := New(strings.NewReader("a,b,Online Alimente,2019-12-05,-1\na,b,Pre-Alimente,2019-12-06,-2\na,b,Totalimente,2019-12-07,-3\n"))
+	if rs, _ := all.Filter("[c=~ali]"); len(rs) != 2 {
+		t.Errorf("unexpected results %v", rs)
+	}
+}
+
+func TestRawLabel(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	rs, err := records.Filter(`[r="11.58 Casă și curățenie + 16.15 Alimente"]`)
+	if err != nil || len(rs) != 2 {
+		t.Fatalf("unexpected results %v, %v", rs, err)
+	} else if rs.Sum() != -27_73 || rs[0].Line != rs[1].Line {
+		t.Errorf("unexpected records %v", rs)
+	}
+
+	if rs, _ := records.Filter(`[c="11.58 Casă și curățenie + 16.15 Alimente"]`); len(rs) != 0 {
+		t.Errorf("unexpected results %v", rs)
+	}
+
+	// records that weren't split have the same raw label
+	if rs1, _ := records.Filter("[r=transfer]"); len(rs1) == 0 {
+		t.Error("expected some results")
+	} else if rs2, _ := records.Filter("[c=transfer]"); fmt.Sprint(rs1) != fmt.Sprint(rs2) {
+		t.Errorf("unexpected results %v", rs1)
+	}
+
+	if rs, _ := records.Filter("[r=*+ 16.15*]"); len(rs) != 2 {
+		t.Errorf("unexpected nr of results %d", len(rs))
+	}
+}
+
+func TestStats(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	stats := records.Stats()
+	if stats.Count != 42 || stats.Total != 46_889_42 || stats.Income != 110_999_99 || stats.Expense != -64_110_57 {
+		t.Errorf("unexpected stats %+v", stats)
+	} else if stats.First.Format("2006-01-02") != "2019-10-03" || stats.Last.Format("2006-01-02") != "2020-01-11" {
+		t.Errorf("unexpected dates %v, %v", stats.First, stats.Last)
+	} else if stats.Merchants != 13 {
+		t.Errorf("unexpected nr of merchants %d", stats.Merchants)
+	}
+
+	if stats.Total != records.Sum() {
+		t.Errorf("unexpected total %d", stats.Total)
+	}
+
+	if stats := (Collection{}).Stats(); stats != (Stats{}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCleanOption(t *testing.T) {
+	data := "Alexandru ,Mega  Image, Food  and  drinks ,2019-12-05,-27.73\nAlexandru,(magazin),\"10.00  Food  A + 5.00 Drinks\",2019-12-06,-15.00\n"
+
+	if all, _ := NewSafe(strings.NewReader(data)); all[0].Receiver != "Mega Image" || all[0].Label != "Food and drinks" || all[1].Label != "Food A" {
+		t.Errorf("unexpected records %q, %q", all[0], all[1])
+	}
+
+	opts := DefaultOptions()
+	opts.Clean = func(text string) string { return text }
+
+	all, err := NewWithOptions(strings.NewReader(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	} else if all[0].Sender != "Alexandru " || all[0].Receiver != "Mega  Image" || all[0].Label != " Food  and  drinks " {
+		t.Errorf("unexpected record %q", all[0])
+	} else if all[1].Label != "Food  A" || all[2].Label != "Drinks" || all[1].Amount != -10_00 || all[1].RawLabel != "10.00  Food  A + 5.00 Drinks" {
+		t.Errorf("unexpected split records %q, %q", all[1], all[2])
+	}
+
+	if rs, _ := all.Filter("[b=mega]"); len(rs) != 1 {
+		t.Errorf("unexpected results %v", rs)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	all := New(strings.NewReader(`a,b,c,2019-12-01,0
+a,b,c,2019-12-02,-12.50
+a,b,c,2019-12-03,49.99
+a,b,c,2019-12-04,-50.00
+a,b,c,2019-12-05,75.00
+a,b,c,2019-12-06,-75.00
+a,b,c,2019-12-07,-1000.00
+`))
+
+	expected := map[int64]int{0: 3, 50_00: 3, 1000_00: 1}
+	if buckets := all.Histogram(50_00); fmt.Sprint(buckets) != fmt.Sprint(expected) {
+		t.Errorf("unexpected buckets %v", buckets)
+	}
+
+	records := New(strings.NewReader(sample))
+
+	var count int
+	for _, n := range records.Histogram(100_00) {
+		count += n
+	}
+
+	if count != len(records) {
+		t.Errorf("unexpected nr of records %d", count)
+	}
+
+	if buckets := all.Histogram(0); len(buckets) != 0 {
+		t.Errorf("unexpected buckets %v", buckets)
+	}
+}
+
+func TestSplitRecords(t *testing.T) {
+	records := New(strings.NewReader(sample))
+
+	split := records.FilterFunc(func(r Record) bool { return r.Split })
+	if len(split) != 10 || len(records)-len(split) != 32 {
+		t.Errorf("unexpected nr of split records %d", len(split))
+	}
+
+	for _, r := range split {
+		if r.Part == 0 || r.RawLabel == "" {
+			t.Errorf("unexpected split record %v", r)
+		}
+	}
+
+	expected := map[string]int{"[p=true]": 10, "[p=false]": 32, "[p!=true]": 32, "[p=1; c=alimente]": 5}
+	for q, count := range expected {
+		if rs, err := records.Filter(q); err != nil || len(rs) != count {
+			t.Errorf("unexpected nr of results for %s: %d, %v", q, len(rs), err)
+		}
+	}
+
+	if _, err := records.Filter("[p=maybe]"); err == nil {
+		t.Error("expected query to fail")
+	}
+}
+
+func TestDateTimeOfDay(t *testing.T) {
+	bucharest := time.FixedZone("EET", 2*60*60)
+	records := Collection{
+		{Sender: "a", Date: time.Date(2019, 12, 5, 15, 30, 0, 0, time.UTC), Amount: -1},
+		{Sender: "a", Date: time.Date(2019, 12, 6, 1, 0, 0, 0, bucharest), Amount: -2}, // the 6th as written, even if it's still the 5th in UTC
+		{Sender: "a", Date: time.Date(2019, 12, 7, 23, 59, 59, 0, time.UTC), Amount: -3},
+	}
+
+	expected := map[string]int{
+		"[d=2019-12-05]":             1,
+		"[d=2019-12-06]":             1,
+		"[d=2019-12-05, 2019-12-07]": 2,
+		"[d=2019-12-05..2019-12-07]": 3,
+		"(d=2019-12-05..2019-12-07)": 1,
+		"[d>2019-12-06]":             2,
+		"(d>2019-12-06)":             1,
+		"(d<2019-12-06]":             2,
+		"(d<2019-12-06)":             1,
+		"[d=2019-12]":                3,
+	}
+
+	for q, count := range expected {
+		if rs, err := records.Filter(q); err != nil || len(rs) != count {
+			t.Errorf("unexpected nr of results for %s: %d, %v", q, len(rs), err)
+		}
+
+		if rs, err := records.Index().Filter(q); err != nil || len(rs) != count {
+			t.Errorf("unexpected nr of indexed results for %s: %d, %v", q, len(rs), err)
+		}
+	}
+}
+
+func TestLoadLocale(t *testing.T) {
+	pack := `{
+		"months": ["Ianuarie", "Februarie", "Martie", "Aprilie", "Mai", "Iunie", "Iulie", "August", "Septembrie", "Octombrie", "Noiembrie", "Decembrie"],
+		"weekdays": ["duminică", "luni", "marți", "miercuri", "joi", "vineri", "sâmbătă"],
+		"unicode": {"ă": "a", "ș": "s", "ț": "t"},
+		"decimal": ","
+	}`
+
+	lc, err := LoadLocale(strings.NewReader(pack))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lc.Month("dec") != 11 || lc.Month("ian") != 0 || lc.Month("foo") != -1 {
+		t.Errorf("unexpected months %v", lc.Months)
+	} else if lc.Weekday("marți") != int(time.Tuesday) {
+		t.Errorf("unexpected weekdays %v", lc.Weekdays)
+	} else if text := lc.Translate("curățenie"); text != "curatenie" {
+		t.Errorf("unexpected translation %s", text)
+	} else if lc.DecimalSep != "," || lc.GroupingSep != "" {
+		t.Errorf("unexpected separators %q, %q", lc.DecimalSep, lc.GroupingSep)
+	}
+
+	if rs, err := New(strings.NewReader(sample)).FilterWithLocale("[d=noiembrie 2019]", lc); err != nil || len(rs) != 9 {
+		t.Errorf("unexpected nr of results %d, %v", len(rs), err)
+	}
+
+	for _, broken := range []string{`{"months": ["ianuarie"]}`, `{"weekdays": ["luni"]}`, `{"months": 12}`, `not json`} {
+		if _, err := LoadLocale(strings.NewReader(broken)); err == nil {
+			t.Errorf("expected %s to fail", broken)
+		}
+	}
+
+	if lc, err := LoadLocale(strings.NewReader("{}")); err != nil || lc.Unicode == nil || lc.Month("ian") != -1 {
+		t.Errorf("unexpected locale %v, %v", lc, err)
+	}
+}
+
+func TestPresetLocale(t *testing.T) {
+	ro, err := PresetLocale("ro")
+	if err != nil {
+		t.Fatal(err)
+	} else if ro.Month("noiembrie") != 10 || ro.Weekday("luni") != int(time.Monday) || ro.Translate("curățenie") != "curatenie" {
+		t.Errorf("unexpected locale %v", ro)
+	}
+
+	if rs, err := New(strings.NewReader(sample)).FilterWithLocale("[d=noiembrie 2019]", ro); err != nil || len(rs) != 9 {
+		t.Errorf("unexpected nr of results %d, %v", len(rs), err)
+	}
+
+	expected := []struct {
+		lang, name string
+		month      int
+	}{{"en-US", "dec", 11}, {"DE", "märz", 2}, {"fr_FR", "août", 7}}
+
+	for _, each := range expected {
+		if lc, err := PresetLocale(each.lang); err != nil {
+			t.Error(err)
+		} else if m := lc.Month(each.name); m != each.month {
+			t.Errorf("unexpected month %d for %s", m, each.lang)
+		}
+	}
+
+	// presets are copied, so changing one doesn't change the others
+	ro.Months[10] = "brumar"
+	if again, _ := PresetLocale("ro"); again.Month("noiembrie") != 10 {
+		t.Error("expected a new locale")
+	}
+
+	if _, err := PresetLocale("xx"); err == nil {
+		t.Error("expected unsupported locale to fail")
+	}
+}
+
+func TestAmbiguousMonth(t *testing.T) {
+	ro, _ := PresetLocale("ro")
+
+	if i, err := ro.LookupMonth("ma"); i != -1 || !errors.Is(err, ErrAmbiguousMonth) {
+		t.Errorf("expected ma to be ambiguous but got %d, %v", i, err)
+	} else if ro.Month("ma") != -1 || ro.Month("iu") != -1 {
+		t.Error("expected ambiguous months to be missing")
+	}
+
+	expected := map[string]int{"mar": 2, "mai": 4, "martie": 2, "iun": 5, "iul": 6, "n": 10}
+	for name, month := range expected {
+		if i, err := ro.LookupMonth(name); err != nil || i != month {
+			t.Errorf("unexpected month for %s: %d, %v", name, i, err)
+		}
+	}
+
+	if i, err := ro.LookupMonth("foo"); i != -1 || err == nil || errors.Is(err, ErrAmbiguousMonth) {
+		t.Errorf("unexpected month %d, %v", i, err)
+	}
+
+	records := New(strings.NewReader(sample))
+	for _, q := range []string{"[d=ma]", "[d=iu]"} {
+		var qe *QueryError
+		if _, err := records.FilterWithLocale(q, ro); !errors.Is(err, ErrAmbiguousMonth) || !errors.Is(err, ErrInvalidValue) {
+			t.Errorf("expected %s to be ambiguous but got %v", q, err)
+		} else if !errors.As(err, &qe) || !strings.HasSuffix(q, qe.Token+"]") || !strings.Contains(qe.Error(), "could be") {
+			t.Errorf("unexpected query error %#v", err)
+		}
+	}
+
+	if rs, err := records.FilterWithLocale("[d=noi 2019]", ro); err != nil || len(rs) != 9 {
+		t.Errorf("unexpected nr of results %d, %v", len(rs), err)
+	}
+}
+
+func TestEnglishMonthFallback(t *testing.T) {
+	ro, _ := PresetLocale("ro")
+	records := New(strings.NewReader(sample))
+
+	pairs := map[string]string{
+		"[d=Dec 2019]":     "[d=decembrie 2019]",
+		"[d=nov 2019]":     "[d=noiembrie 2019]",
+		"[d=oct 2019]":     "[d=octombrie 2019]",
+		"[d=5 dec 2019]":   "[d=5 decembrie 2019]",
+		"[d=Jan 2020]":     "[d=ianuarie 2020]",
+		"[d=sept 2019]":    "[d=septembrie 2019]",
+		"[d=october 2019]": "[d=2019-10]",
+	}
+
+	for q1, q2 := range pairs {
+		rs1, err1 := records.FilterWithLocale(q1, ro)
+		rs2, err2 := records.FilterWithLocale(q2, ro)
+		if err1 != nil || err2 != nil || fmt.Sprint(rs1) != fmt.Sprint(rs2) {
+			t.Errorf("expected %s to match %s but got %d and %d (%v, %v)", q1, q2, len(rs1), len(rs2), err1, err2)
+		}
+	}
+
+	// the locale comes first, "mai" is may in romanian
+	if i := ro.Month("mai"); i != 4 {
+		t.Errorf("unexpected month %d", i)
+	} else if i := ro.Month("feb"); i != 1 {
+		t.Errorf("unexpected month %d", i)
+	} else if i := ro.Month("Aug"); i != 7 {
+		t.Errorf("unexpected month %d", i)
+	}
+
+	if i, err := (&Locale{}).LookupMonth("de"); i != -1 || err == nil {
+		t.Errorf("expected short names to be unknown but got %d", i)
+	}
+}
+
+func TestPresetLocaleQueries(t *testing.T) {
+	de, _ := PresetLocale("de")
+	fr, _ := PresetLocale("fr")
+	ro, _ := PresetLocale("ro")
+
+	all := New(strings.NewReader("a,b,c,2020-02-07,-1\na,b,c,2020-03-07,-2\na,b,c,2019-12-07,-3\na,b,c,2020-03-14,-4\n"))
+
+	expected := []struct {
+		lc    *Locale
+		q     string
+		count int
+	}{
+		{de, "[d=märz 2020]", 2},
+		{de, "[d=maerz 2020]", 2},
+		{de, "[d=7 märz 2020]", 1},
+		{de, "[d=dezember 2019]", 1},
+		{fr, "[d=février 2020]", 1},
+		{fr, "[d=fevrier 2020]", 1},
+		{fr, "[d=décembre 2019]", 1},
+		{fr, "[d=decembre 2019]", 1},
+		{ro, "[w=sambata]", 3},
+		{ro, "[w=sâmbătă]", 3},
+		{fr, "[w=vendredi]", 1},
+	}
+
+	for _, each := range expected {
+		if rs, err := all.FilterWithLocale(each.q, each.lc); err != nil || len(rs) != each.count {
+			t.Errorf("unexpected nr of results for %s: %d, %v", each.q, len(rs), err)
+		}
+	}
+}